@@ -11,100 +11,320 @@ package cache
 
 import (
 	"crypto/sha1"
-	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// Reasons for removing messages from the cache, passed to Config.OnEvict.
+const (
+	EvictCapacity = "capacity"
+	EvictExpired  = "expired"
+)
+
+const (
+	// maxShards is the number of shards of large caches.
+	maxShards = 256
+	// minShardCapacity is the capacity below which a shard isn't split further,
+	// as eviction is only least recently used within a shard.
+	minShardCapacity = 128
+)
+
 // Elem hold an answer and additional section that returned from the cache.
 // The signature is put in answer, extra is empty there. This wastes some memory.
 type elem struct {
+	key        string
+	inserted   time.Time // time added, the TTLs of msg are relative to it
 	expiration time.Time // time added + TTL, after this the elem is invalid
 	msg        *dns.Msg
+	size       int // approximate memory used by key and msg
 }
 
-// Cache is a cache that holds on the a number of RRs or DNS messages. The cache
-// eviction is randomized.
+// Cache is a cache that holds on the a number of RRs or DNS messages. It is
+// split in shards with their own locks. When a shard is full its least
+// recently used messages are evicted.
 type Cache struct {
-	sync.RWMutex
-
 	capacity int
-	m        map[string]*elem
-	ttl      time.Duration
+	shards   []*shard
+	config   Config
+}
+
+// Config sets how long messages are cached, in seconds, and how much memory
+// the cache may use.
+type Config struct {
+	// TTL of negative responses without SOA record.
+	TTL int
+	// Bounds of the TTLs of records, 0 for no upper bound.
+	MinTTL int
+	MaxTTL int
+	// Upper bound of the TTL of negative responses, 0 for no upper bound.
+	MaxNegTTL int
+	// TTL of SERVFAIL responses, 0 disables caching them.
+	ServFailTTL int
+	// How long expired messages are kept to be returned by Stale, 0 removes
+	// them when they expire.
+	StaleTTL int
+	// Upper bound of the size of the cached messages in bytes, 0 for no limit.
+	MaxBytes int
+	// Number of shards, rounded down to a power of two. 0 picks a number
+	// based on the capacity.
+	Shards int
+	// OnEvict is called with EvictCapacity or EvictExpired when a message
+	// is removed from the cache.
+	OnEvict func(reason string)
 }
 
-// New returns a new cache with the capacity and the ttl specified.
-func New(capacity, ttl int) *Cache {
-	c := new(Cache)
-	c.m = make(map[string]*elem)
-	c.capacity = capacity
-	c.ttl = time.Duration(ttl) * time.Second
+// New returns a new cache with the capacity specified. Messages are cached
+// for the lowest TTL of their records, NXDOMAIN and NODATA responses for the
+// negative TTL of their SOA record.
+func New(capacity int, config Config) *Cache {
+	c := &Cache{capacity: capacity, config: config}
+	n := shardCount(capacity, config.Shards)
+	shardCapacity := (capacity + n - 1) / n
+	shardBytes := 0
+	if config.MaxBytes > 0 {
+		shardBytes = (config.MaxBytes + n - 1) / n
+	}
+	c.shards = make([]*shard, n)
+	for i := range c.shards {
+		c.shards[i] = newShard(shardCapacity, shardBytes, time.Duration(config.StaleTTL)*time.Second, config.OnEvict)
+	}
 	return c
 }
 
+// shardCount returns the number of shards for a cache, a power of two.
+func shardCount(capacity, shards int) int {
+	if shards <= 0 {
+		shards = capacity / minShardCapacity
+		if shards > maxShards {
+			shards = maxShards
+		}
+	}
+	n := 1
+	for n*2 <= shards {
+		n *= 2
+	}
+	return n
+}
+
+// shard returns the shard of the message for key, using the FNV-1a hash of key.
+func (c *Cache) shard(key string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h&uint32(len(c.shards)-1)]
+}
+
 func (c *Cache) Capacity() int { return c.capacity }
 
-func (c *Cache) Remove(s string) {
-	c.Lock()
-	delete(c.m, s)
-	c.Unlock()
+// Len returns the number of messages in the cache.
+func (c *Cache) Len() int {
+	total := 0
+	for _, s := range c.shards {
+		n, _ := s.stats()
+		total += n
+	}
+	return total
 }
 
-// EvictRandom removes a random member a the cache.
-// Must be called under a write lock.
-func (c *Cache) EvictRandom() {
-	clen := len(c.m)
-	if clen < c.capacity {
-		return
+// Bytes returns the approximate size of the cached messages in bytes.
+func (c *Cache) Bytes() int {
+	total := 0
+	for _, s := range c.shards {
+		_, bytes := s.stats()
+		total += bytes
 	}
-	i := c.capacity - clen
-	for k, _ := range c.m {
-		delete(c.m, k)
-		i--
-		if i == 0 {
-			break
+	return total
+}
+
+// Flush removes all messages from the cache and returns how many there were.
+func (c *Cache) Flush() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.flush()
+	}
+	return n
+}
+
+// Each calls f with a copy of every message in the cache and its expiration
+// time. The shards are locked one at a time, so f doesn't see a snapshot of the
+// whole cache.
+func (c *Cache) Each(f func(msg *dns.Msg, expiration time.Time)) {
+	for _, s := range c.shards {
+		for _, e := range s.copyElems() {
+			f(e.msg, e.expiration)
 		}
 	}
 }
 
-// InsertMessage inserts a message in the Cache. We will cache it for ttl seconds, which
-// should be a small (60...300) integer.
+func (c *Cache) Remove(s string) {
+	c.shard(s).removeKey(s, false)
+}
+
+// RemoveFunc removes the messages for which f returns true and returns how
+// many were removed. f is called with the cached messages and must not
+// change them.
+func (c *Cache) RemoveFunc(f func(msg *dns.Msg) bool) int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.removeFunc(f)
+	}
+	return n
+}
+
+// removeExpired removes the message for s if it is expired and not kept to
+// be served stale any longer.
+func (c *Cache) removeExpired(s string) {
+	c.shard(s).removeKey(s, true)
+}
+
+// InsertMessage inserts a message in the Cache, replacing the message cached
+// for s. The TTLs of the records are clamped to the TTL bounds of the cache and
+// the message is cached until the lowest of them expires. Messages with a TTL
+// of 0 are not cached.
 func (c *Cache) InsertMessage(s string, msg *dns.Msg) {
 	if c.capacity <= 0 {
 		return
 	}
 
-	c.Lock()
-	if _, ok := c.m[s]; !ok {
-		c.m[s] = &elem{time.Now().UTC().Add(c.ttl), msg.Copy()}
+	msg = msg.Copy()
+	ttl := time.Duration(c.messageTTL(msg)) * time.Second
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	c.shard(s).insert(&elem{key: s, inserted: now, expiration: now.Add(ttl), msg: msg, size: elemSize(s, msg)})
+}
+
+// elemOverhead approximates the memory used by the cache for a message
+// besides its wire format.
+const elemOverhead = 256
+
+// elemSize approximates the memory used by a cached message.
+func elemSize(key string, msg *dns.Msg) int {
+	return len(key) + msg.Len() + elemOverhead
+}
 
+// messageTTL adjusts the TTLs of the records in msg and returns how long msg
+// is cached.
+func (c *Cache) messageTTL(msg *dns.Msg) uint32 {
+	switch {
+	case msg.Rcode == dns.RcodeServerFailure:
+		// Server failures are transient, cache them briefly if at all (RFC 2308, section 7.1)
+		return uint32(c.config.ServFailTTL)
+	case msg.Rcode == dns.RcodeNameError, msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0:
+		return c.negativeTTL(msg)
+	case msg.Rcode == dns.RcodeSuccess:
+		ttl, _ := c.clampTTLs(msg, false)
+		return ttl
 	}
-	c.EvictRandom()
-	c.Unlock()
+	return 0
+}
+
+// negativeTTL returns the TTL of an NXDOMAIN or NODATA response, the lower of
+// the TTL and the MINIMUM field of the SOA record in the authority section
+// (RFC 2308, section 5) capped at MaxNegTTL. The SOA record is given this TTL.
+func (c *Cache) negativeTTL(msg *dns.Msg) uint32 {
+	var soa *dns.SOA
+	for _, rr := range msg.Ns {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+			break
+		}
+	}
+
+	ttl := uint32(c.config.TTL)
+	if soa != nil {
+		ttl = soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+	}
+	if max := uint32(c.config.MaxNegTTL); max > 0 && ttl > max {
+		ttl = max
+	}
+	// A CNAME chain leading to the name that doesn't exist may expire earlier
+	if min, ok := c.clampTTLs(msg, true); ok && min < ttl {
+		ttl = min
+	}
+	if soa != nil {
+		soa.Hdr.Ttl = ttl
+	}
+	return ttl
+}
+
+// clampTTLs raises the TTLs of the records in msg to MinTTL and caps them at
+// MaxTTL, skipping the SOA records in the authority section if skipSOA is
+// true. It returns the lowest TTL, or false if there are no records.
+func (c *Cache) clampTTLs(msg *dns.Msg, skipSOA bool) (uint32, bool) {
+	minTTL, maxTTL := uint32(c.config.MinTTL), uint32(c.config.MaxTTL)
+	var min uint32
+	found := false
+	for i, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT || skipSOA && i == 1 && h.Rrtype == dns.TypeSOA {
+				continue
+			}
+			if h.Ttl < minTTL {
+				h.Ttl = minTTL
+			}
+			if maxTTL > 0 && h.Ttl > maxTTL {
+				h.Ttl = maxTTL
+			}
+			if !found || h.Ttl < min {
+				min = h.Ttl
+				found = true
+			}
+		}
+	}
+	return min, found
 }
 
 // Search returns a dns.Msg, the expiration time and a boolean indicating if we found something
-// in the cache.
+// in the cache. The TTLs of the records are decremented by the time the
+// message spent in the cache.
 func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
 	if c.capacity <= 0 {
 		return nil, time.Time{}, false
 	}
-	c.RLock()
-	if e, ok := c.m[s]; ok {
-		e1 := e.msg.Copy()
-		c.RUnlock()
-		return e1, e.expiration, true
+	m, inserted, expiration, ok := c.shard(s).search(s)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	decrementTTLs(m, uint32(time.Since(inserted)/time.Second))
+	return m, expiration, true
+}
+
+// decrementTTLs subtracts elapsed seconds from the TTLs of the records in msg.
+func decrementTTLs(msg *dns.Msg, elapsed uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if h.Ttl > elapsed {
+				h.Ttl -= elapsed
+			} else {
+				h.Ttl = 0
+			}
+		}
 	}
-	c.RUnlock()
-	return nil, time.Time{}, false
 }
 
 // Key creates a hash key from a question section. It creates a different key
-// for requests with DNSSEC.
+// for each class and for requests with DNSSEC.
 func Key(q dns.Question, dnssec, tcp bool) string {
 	h := sha1.New()
 	i := append([]byte(q.Name), packUint16(q.Qtype)...)
+	i = append(i, packUint16(q.Qclass)...)
 	if dnssec {
 		i = append(i, byte(255))
 	}
@@ -5,6 +5,8 @@
 package cache
 
 import (
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,7 +27,7 @@ func newMsg(zone string, typ uint16) *dns.Msg {
 }
 
 func TestInsertMessage(t *testing.T) {
-	c := New(10, testTTL)
+	c := New(10, Config{TTL: testTTL})
 
 	testcases := []testcase{
 		{newMsg("miek.nl.", dns.TypeMX), false, false},
@@ -59,27 +61,411 @@ func TestInsertMessage(t *testing.T) {
 	}
 }
 
+func newRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// age makes the cached message for key look older by d.
+func age(c *Cache, key string, d time.Duration) {
+	s := c.shard(key)
+	s.Lock()
+	e := s.m[key].Value.(*elem)
+	e.inserted = e.inserted.Add(-d)
+	e.expiration = e.expiration.Add(-d)
+	s.Unlock()
+}
+
 func TestExpireMessage(t *testing.T) {
-	c := New(10, testTTL-1)
+	c := New(10, Config{TTL: 60})
+
+	m := newMsg("miek.nl.", dns.TypeMX)
+	m.Answer = []dns.RR{newRR("miek.nl. 300 IN MX 10 mx1.miek.nl."), newRR("miek.nl. 120 IN MX 20 mx2.miek.nl.")}
+	m.Extra = []dns.RR{newRR("mx1.miek.nl. 3600 IN A 192.0.2.1")}
+	m.SetEdns0(4096, false)
+	key := Key(m.Question[0], false, false)
+	c.InsertMessage(key, m)
+
+	// Expires with the lowest record TTL, OPT doesn't count
+	_, exp, _ := c.Search(key)
+	if ttl := time.Until(exp); ttl < 119*time.Second || ttl > 120*time.Second {
+		t.Fatalf("bad expiration, expected 120s, got %s", ttl)
+	}
+
+	// TTLs are decremented by the time spent in the cache
+	age(c, key, 100*time.Second)
+	m1 := c.Hit(m.Question[0], false, false, m.Id)
+	if m1 == nil {
+		t.Fatal("bad cache miss")
+	}
+	if m1.Answer[0].Header().Ttl != 200 || m1.Answer[1].Header().Ttl != 20 || m1.Extra[0].Header().Ttl != 3500 {
+		t.Fatalf("bad TTLs, expected 200, 20 and 3500, got %s", m1)
+	}
+	if m1.IsEdns0() == nil {
+		t.Fatal("bad message, expected OPT record")
+	}
+
+	age(c, key, 21*time.Second)
+	if m1 := c.Hit(m.Question[0], false, false, m.Id); m1 != nil {
+		t.Fatalf("bad cache hit, expected <nil>, got %s", m1)
+	}
+	if c.Len() != 0 {
+		t.Fatalf("bad length, expected expired message to be removed, got %d", c.Len())
+	}
+}
+
+func TestClampTTL(t *testing.T) {
+	c := New(10, Config{TTL: 60, MinTTL: 30, MaxTTL: 600})
+
+	m := newMsg("miek.nl.", dns.TypeA)
+	m.Answer = []dns.RR{newRR("miek.nl. 5 IN A 192.0.2.1"), newRR("miek.nl. 86400 IN A 192.0.2.2")}
+	key := Key(m.Question[0], false, false)
+	c.InsertMessage(key, m)
+
+	m1, exp, found := c.Search(key)
+	if !found {
+		t.Fatal("bad cache miss")
+	}
+	if m1.Answer[0].Header().Ttl != 30 || m1.Answer[1].Header().Ttl != 600 {
+		t.Fatalf("bad TTLs, expected 30 and 600, got %s", m1)
+	}
+	if ttl := time.Until(exp); ttl < 29*time.Second || ttl > 30*time.Second {
+		t.Fatalf("bad expiration, expected 30s, got %s", ttl)
+	}
+	if m.Answer[0].Header().Ttl != 5 {
+		t.Fatal("bad TTL, inserted message was modified")
+	}
+}
+
+func TestKeyClass(t *testing.T) {
+	c := New(10, Config{TTL: 60, MinTTL: 30})
+
+	m := newMsg("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	m.Answer = []dns.RR{newRR(`version.bind. 0 CH TXT "go-dnsmasq"`)}
+	c.InsertMessage(Key(m.Question[0], false, false), m)
+
+	in := m.Question[0]
+	in.Qclass = dns.ClassINET
+	if m1 := c.Hit(in, false, false, m.Id); m1 != nil {
+		t.Fatalf("bad cache hit for class IN, expected <nil>, got %s", m1)
+	}
+	if m1 := c.Hit(m.Question[0], false, false, m.Id); m1 == nil {
+		t.Fatal("bad cache miss for class CHAOS")
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	c := New(10, Config{TTL: 60, MinTTL: 30, MaxNegTTL: 900})
+
+	testcases := []struct {
+		m      *dns.Msg
+		rcode  int
+		ns     []dns.RR
+		answer []dns.RR
+		ttl    uint32
+	}{
+		// The lower of the SOA TTL and MINIMUM
+		{newMsg("nx1.miek.nl.", dns.TypeA), dns.RcodeNameError,
+			[]dns.RR{newRR("miek.nl. 3600 IN SOA ns.miek.nl. hostmaster.miek.nl. 1 3600 600 86400 300")}, nil, 300},
+		{newMsg("nx2.miek.nl.", dns.TypeA), dns.RcodeNameError,
+			[]dns.RR{newRR("miek.nl. 120 IN SOA ns.miek.nl. hostmaster.miek.nl. 1 3600 600 86400 300")}, nil, 120},
+		// Capped at MaxNegTTL, MinTTL doesn't apply
+		{newMsg("nx3.miek.nl.", dns.TypeA), dns.RcodeNameError,
+			[]dns.RR{newRR("miek.nl. 3600 IN SOA ns.miek.nl. hostmaster.miek.nl. 1 3600 600 86400 3600")}, nil, 900},
+		{newMsg("nx4.miek.nl.", dns.TypeA), dns.RcodeNameError,
+			[]dns.RR{newRR("miek.nl. 10 IN SOA ns.miek.nl. hostmaster.miek.nl. 1 3600 600 86400 3600")}, nil, 10},
+		// NODATA
+		{newMsg("miek.nl.", dns.TypeAAAA), dns.RcodeSuccess,
+			[]dns.RR{newRR("miek.nl. 3600 IN SOA ns.miek.nl. hostmaster.miek.nl. 1 3600 600 86400 200")}, nil, 200},
+		// A CNAME leading to the name that doesn't exist
+		{newMsg("www.miek.nl.", dns.TypeA), dns.RcodeNameError,
+			[]dns.RR{newRR("miek.nl. 3600 IN SOA ns.miek.nl. hostmaster.miek.nl. 1 3600 600 86400 300")},
+			[]dns.RR{newRR("www.miek.nl. 40 IN CNAME nx.miek.nl.")}, 40},
+		// Without SOA
+		{newMsg("nx5.miek.nl.", dns.TypeA), dns.RcodeNameError, nil, nil, 60},
+	}
+	for _, tc := range testcases {
+		tc.m.Rcode, tc.m.Ns, tc.m.Answer = tc.rcode, tc.ns, tc.answer
+		key := Key(tc.m.Question[0], false, false)
+		c.InsertMessage(key, tc.m)
+
+		m1, exp, found := c.Search(key)
+		if !found {
+			t.Fatalf("%s: bad cache miss", tc.m.Question[0].Name)
+		}
+		ttl := time.Duration(tc.ttl) * time.Second
+		if d := time.Until(exp); d < ttl-time.Second || d > ttl {
+			t.Errorf("%s: bad expiration, expected %s, got %s", tc.m.Question[0].Name, ttl, d)
+		}
+		if len(m1.Ns) > 0 && m1.Ns[0].Header().Ttl != tc.ttl {
+			t.Errorf("%s: bad SOA TTL, expected %d, got %d", tc.m.Question[0].Name, tc.ttl, m1.Ns[0].Header().Ttl)
+		}
+	}
+}
+
+func TestErrorTTL(t *testing.T) {
+	c := New(10, Config{TTL: 60})
+
+	for _, rcode := range []int{dns.RcodeServerFailure, dns.RcodeRefused, dns.RcodeFormatError} {
+		m := newMsg("miek.nl.", dns.TypeA)
+		m.Rcode = rcode
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
+	if c.Len() != 0 {
+		t.Fatalf("bad length, expected error responses not to be cached, got %d", c.Len())
+	}
+
+	c = New(10, Config{TTL: 60, ServFailTTL: 5})
+	m := newMsg("miek.nl.", dns.TypeA)
+	m.Rcode = dns.RcodeServerFailure
+	key := Key(m.Question[0], false, false)
+	c.InsertMessage(key, m)
+	_, exp, found := c.Search(key)
+	if d := time.Until(exp); !found || d < 4*time.Second || d > 5*time.Second {
+		t.Fatalf("bad expiration, expected SERVFAIL to be cached for 5s, got %s", d)
+	}
+
+	// Messages with a TTL of 0 are not cached
+	m = newMsg("zero.miek.nl.", dns.TypeA)
+	m.Answer = []dns.RR{newRR("zero.miek.nl. 0 IN A 192.0.2.1")}
+	c.InsertMessage(Key(m.Question[0], false, false), m)
+	if m1 := c.Hit(m.Question[0], false, false, m.Id); m1 != nil {
+		t.Fatalf("bad cache hit, expected <nil>, got %s", m1)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := New(10, Config{TTL: testTTL})
+
+	for _, tc := range []testcase{
+		{newMsg("miek.nl.", dns.TypeMX), false, false},
+		{newMsg("miek2.nl.", dns.TypeNS), false, false},
+	} {
+		c.InsertMessage(Key(tc.m.Question[0], tc.dnssec, tc.tcp), tc.m)
+	}
+	if c.Len() != 2 {
+		t.Fatalf("bad length, expected 2, got %d", c.Len())
+	}
+
+	names := make(map[string]bool)
+	c.Each(func(m *dns.Msg, expiration time.Time) {
+		names[m.Question[0].Name] = true
+		if expiration.Before(time.Now()) {
+			t.Fatalf("bad expiration for %s: %s", m.Question[0].Name, expiration)
+		}
+	})
+	if !names["miek.nl."] || !names["miek2.nl."] {
+		t.Fatalf("bad messages, got %v", names)
+	}
+
+	c.Flush()
+	if c.Len() != 0 {
+		t.Fatalf("bad length after flush, expected 0, got %d", c.Len())
+	}
+}
 
-	tc := testcase{newMsg("miek.nl.", dns.TypeMX), false, false}
-	c.InsertMessage(Key(tc.m.Question[0], tc.dnssec, tc.tcp), tc.m)
+func TestRemoveFunc(t *testing.T) {
+	c := New(10, Config{TTL: testTTL})
+	for _, name := range []string{"miek.nl.", "www.miek.nl.", "miek2.nl."} {
+		m := newMsg(name, dns.TypeA)
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
 
-	m1 := c.Hit(tc.m.Question[0], tc.dnssec, tc.tcp, tc.m.Id)
-	if m1.Question[0].Qtype != tc.m.Question[0].Qtype {
-		t.Fatalf("bad Qtype, expected %d, got %d:", tc.m.Question[0].Qtype, m1.Question[0].Qtype)
+	n := c.RemoveFunc(func(m *dns.Msg) bool { return dns.IsSubDomain("miek.nl.", m.Question[0].Name) })
+	if n != 2 {
+		t.Fatalf("expected 2 removed messages, got %d", n)
 	}
-	if m1.Question[0].Name != tc.m.Question[0].Name {
-		t.Fatalf("bad Qtype, expected %s, got %s:", tc.m.Question[0].Name, m1.Question[0].Name)
+	if c.Len() != 1 {
+		t.Fatalf("bad length, expected 1, got %d", c.Len())
 	}
+	c.Each(func(m *dns.Msg, expiration time.Time) {
+		if m.Question[0].Name != "miek2.nl." {
+			t.Fatalf("expected miek2.nl. to be kept, got %s", m.Question[0].Name)
+		}
+	})
+}
+
+func TestEvictLRU(t *testing.T) {
+	evicted := map[string]int{}
+	c := New(2, Config{TTL: 60, OnEvict: func(reason string) { evicted[reason]++ }})
+
+	keys := make([]string, 3)
+	for i, name := range []string{"a.example.", "b.example.", "c.example."} {
+		m := newMsg(name, dns.TypeA)
+		keys[i] = Key(m.Question[0], false, false)
+		c.InsertMessage(keys[i], m)
+		if i == 1 {
+			// Using a.example. makes b.example. the least recently used
+			if _, _, ok := c.Search(keys[0]); !ok {
+				t.Fatal("expected a.example. to be cached")
+			}
+		}
+	}
+
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 messages, got %d", c.Len())
+	}
+	for i, cached := range []bool{true, false, true} {
+		if _, _, ok := c.Search(keys[i]); ok != cached {
+			t.Errorf("expected key %d cached to be %v", i, cached)
+		}
+	}
+	if evicted[EvictCapacity] != 1 {
+		t.Fatalf("expected 1 eviction, got %v", evicted)
+	}
+
+	age(c, keys[0], time.Minute)
+	if m := c.Hit(dns.Question{Name: "a.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, false, 1); m != nil {
+		t.Fatalf("expected an expired message, got %s", m)
+	}
+	if evicted[EvictExpired] != 1 || c.Len() != 1 {
+		t.Fatalf("expected 1 expired message, got %v and %d messages", evicted, c.Len())
+	}
+}
+
+func TestEvictBytes(t *testing.T) {
+	m := newMsg("a.example.", dns.TypeA)
+	size := elemSize(Key(m.Question[0], false, false), m)
+	c := New(100, Config{TTL: 60, MaxBytes: 3 * size})
+
+	for _, name := range []string{"a.example.", "b.example.", "c.example.", "d.example."} {
+		m := newMsg(name, dns.TypeA)
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
+	if c.Len() != 3 || c.Bytes() != 3*size {
+		t.Fatalf("expected 3 messages of %d bytes, got %d and %d bytes", size, c.Len(), c.Bytes())
+	}
+	if _, _, ok := c.Search(Key(newMsg("a.example.", dns.TypeA).Question[0], false, false)); ok {
+		t.Fatal("expected the oldest message to be evicted")
+	}
+
+	c.Flush()
+	if c.Bytes() != 0 {
+		t.Fatalf("expected 0 bytes after flushing, got %d", c.Bytes())
+	}
+}
 
-	time.Sleep(testTTL)
+func TestShardCount(t *testing.T) {
+	for _, tc := range []struct{ capacity, shards, expected int }{
+		{0, 0, 1},
+		{100, 0, 1},
+		{1000, 0, 4},
+		{100000, 0, 256},
+		{100, 6, 4},
+		{100, 1, 1},
+	} {
+		if n := shardCount(tc.capacity, tc.shards); n != tc.expected {
+			t.Errorf("capacity %d, shards %d: expected %d shards, got %d", tc.capacity, tc.shards, tc.expected, n)
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	c := New(1000, Config{TTL: 60, Shards: 8})
+	for i := 0; i < 2000; i++ {
+		m := newMsg(fmt.Sprintf("host%d.example.", i), dns.TypeA)
+		c.InsertMessage(Key(m.Question[0], false, false), m)
+	}
+
+	if n := c.Len(); n > 1000 || n < 900 {
+		t.Fatalf("expected about 1000 messages, got %d", n)
+	}
+	for i, s := range c.shards {
+		if n, _ := s.stats(); n != s.capacity {
+			t.Errorf("expected shard %d to be full, got %d of %d messages", i, n, s.capacity)
+		}
+	}
+	n := 0
+	c.Each(func(*dns.Msg, time.Time) { n++ })
+	if n != c.Len() {
+		t.Fatalf("expected Each to visit %d messages, got %d", c.Len(), n)
+	}
+	if flushed := c.Flush(); flushed != n || c.Len() != 0 {
+		t.Fatalf("expected %d flushed messages, got %d", n, flushed)
+	}
+}
+
+// benchmarkKeys returns n cache keys and messages for different names.
+func benchmarkKeys(n int) ([]string, []*dns.Msg) {
+	keys, msgs := make([]string, n), make([]*dns.Msg, n)
+	for i := range keys {
+		m := newMsg(fmt.Sprintf("host%d.example.", i), dns.TypeA)
+		m.Answer = []dns.RR{newRR(fmt.Sprintf("host%d.example. 3600 IN A 192.0.2.1", i))}
+		keys[i], msgs[i] = Key(m.Question[0], false, false), m
+	}
+	return keys, msgs
+}
+
+// Compare the scaling across cores of a single lock and of the sharded cache
+// with go test -bench . -cpu 1,2,4,8
+func BenchmarkSearch(b *testing.B) {
+	keys, msgs := benchmarkKeys(10000)
+	for _, shards := range []int{1, 0} {
+		c := New(len(keys), Config{TTL: 60, MaxTTL: 86400, Shards: shards})
+		for i, key := range keys {
+			c.InsertMessage(key, msgs[i])
+		}
+		b.Run(fmt.Sprintf("shards=%d", len(c.shards)), func(b *testing.B) {
+			var next uint32
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint32(&next, 7919))
+				for pb.Next() {
+					c.Search(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkInsertMessage(b *testing.B) {
+	keys, msgs := benchmarkKeys(20000)
+	for _, shards := range []int{1, 0} {
+		// Half the keys fit, so inserting also evicts
+		c := New(len(keys)/2, Config{TTL: 60, MaxTTL: 86400, Shards: shards})
+		b.Run(fmt.Sprintf("shards=%d", len(c.shards)), func(b *testing.B) {
+			var next uint32
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint32(&next, 7919))
+				for pb.Next() {
+					c.InsertMessage(keys[i%len(keys)], msgs[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestStale(t *testing.T) {
+	c := New(10, Config{TTL: 60, StaleTTL: 300})
+	m := newMsg("miek.nl.", dns.TypeA)
+	m.Answer = []dns.RR{newRR("miek.nl. 60 IN A 192.0.2.1")}
+	key := Key(m.Question[0], false, false)
+	c.InsertMessage(key, m)
+
+	if m1 := c.Stale(m.Question[0], false, false, 1); m1 != nil {
+		t.Fatalf("expected no stale message before it expires, got %s", m1)
+	}
+
+	age(c, key, 2*time.Minute)
+	if m1 := c.Hit(m.Question[0], false, false, 1); m1 != nil {
+		t.Fatalf("expected an expired message, got %s", m1)
+	}
+	m1 := c.Stale(m.Question[0], false, false, 2)
+	if m1 == nil || m1.Id != 2 || m1.Answer[0].Header().Ttl != StaleAnswerTTL {
+		t.Fatalf("expected a stale message with TTL %d, got %v", StaleAnswerTTL, m1)
+	}
 
-	m1 = c.Hit(tc.m.Question[0], tc.dnssec, tc.tcp, tc.m.Id)
-	if m1.Question[0].Qtype != tc.m.Question[0].Qtype {
-		t.Fatalf("bad Qtype, expected %d, got %d:", tc.m.Question[0].Qtype, m1.Question[0].Qtype)
+	age(c, key, 5*time.Minute)
+	if m1 := c.Stale(m.Question[0], false, false, 1); m1 != nil {
+		t.Fatalf("expected no stale message after %ds, got %s", c.config.StaleTTL, m1)
 	}
-	if m1.Question[0].Name != tc.m.Question[0].Name {
-		t.Fatalf("bad Qtype, expected %s, got %s:", tc.m.Question[0].Name, m1.Question[0].Name)
+	c.Hit(m.Question[0], false, false, 1)
+	if c.Len() != 0 {
+		t.Fatalf("expected the message to be removed, got %d messages", c.Len())
 	}
 }
@@ -11,7 +11,8 @@ import (
 )
 
 // Hit returns a dns message from the cache. If the message's TTL is expired nil
-// is returned and the message is removed from the cache.
+// is returned and the message is removed from the cache, unless it is kept to
+// be returned by Stale.
 func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16) *dns.Msg {
 	key := Key(question, dnssec, tcp)
 	m1, exp, hit := c.Search(key)
@@ -25,7 +26,35 @@ func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16) *dns.
 			return m1
 		}
 		// Expired! /o\
-		c.Remove(key)
+		c.removeExpired(key)
 	}
 	return nil
 }
+
+// StaleAnswerTTL is the TTL of the records of stale messages, as recommended
+// by RFC 8767.
+const StaleAnswerTTL = 30
+
+// Stale returns an expired dns message from the cache that is kept for
+// StaleTTL seconds, with the TTLs of its records set to StaleAnswerTTL. If
+// there is no such message nil is returned.
+func (c *Cache) Stale(question dns.Question, dnssec, tcp bool, msgid uint16) *dns.Msg {
+	if c.config.StaleTTL <= 0 {
+		return nil
+	}
+	m1, exp, hit := c.Search(Key(question, dnssec, tcp))
+	if !hit || time.Since(exp) < 0 || time.Since(exp) >= time.Duration(c.config.StaleTTL)*time.Second {
+		return nil
+	}
+	for _, section := range [][]dns.RR{m1.Answer, m1.Ns, m1.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = StaleAnswerTTL
+			}
+		}
+	}
+	m1.Id = msgid
+	m1.Compress = true
+	m1.Truncated = false
+	return m1
+}
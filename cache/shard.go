@@ -0,0 +1,144 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// shard is a part of the cache with its own lock and LRU list. Messages are
+// assigned to shards by the hash of their key, so queries for different names
+// rarely contend for the same lock.
+type shard struct {
+	sync.Mutex
+
+	capacity int
+	maxBytes int           // 0 for no limit
+	stale    time.Duration // how long expired messages are kept
+	m        map[string]*list.Element
+	lru      *list.List // of *elem, most recently used first
+	bytes    int
+	onEvict  func(reason string)
+}
+
+func newShard(capacity, maxBytes int, stale time.Duration, onEvict func(reason string)) *shard {
+	return &shard{
+		capacity: capacity,
+		maxBytes: maxBytes,
+		stale:    stale,
+		m:        make(map[string]*list.Element),
+		lru:      list.New(),
+		onEvict:  onEvict,
+	}
+}
+
+// search returns a copy of the message for key and marks it as recently used.
+func (s *shard) search(key string) (msg *dns.Msg, inserted, expiration time.Time, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	le, ok := s.m[key]
+	if !ok {
+		return nil, time.Time{}, time.Time{}, false
+	}
+	s.lru.MoveToFront(le)
+	e := le.Value.(*elem)
+	return e.msg.Copy(), e.inserted, e.expiration, true
+}
+
+// insert adds e, replacing the message cached for its key, and evicts the
+// least recently used messages if the shard is full.
+func (s *shard) insert(e *elem) {
+	s.Lock()
+	defer s.Unlock()
+	if le, ok := s.m[e.key]; ok {
+		s.remove(le)
+	}
+	s.m[e.key] = s.lru.PushFront(e)
+	s.bytes += e.size
+	for len(s.m) > s.capacity || s.maxBytes > 0 && s.bytes > s.maxBytes {
+		s.remove(s.lru.Back())
+		s.evicted(EvictCapacity)
+	}
+}
+
+func (s *shard) removeKey(key string, onlyExpired bool) {
+	s.Lock()
+	defer s.Unlock()
+	le, ok := s.m[key]
+	if !ok {
+		return
+	}
+	if onlyExpired {
+		if time.Since(le.Value.(*elem).expiration) < s.stale {
+			return
+		}
+		s.evicted(EvictExpired)
+	}
+	s.remove(le)
+}
+
+// removeFunc removes the messages for which f returns true and returns how
+// many there were.
+func (s *shard) removeFunc(f func(msg *dns.Msg) bool) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for le := s.lru.Front(); le != nil; {
+		next := le.Next()
+		if f(le.Value.(*elem).msg) {
+			s.remove(le)
+			n++
+		}
+		le = next
+	}
+	return n
+}
+
+// remove deletes the element from the shard. Must be called under a lock.
+func (s *shard) remove(le *list.Element) {
+	e := s.lru.Remove(le).(*elem)
+	delete(s.m, e.key)
+	s.bytes -= e.size
+}
+
+func (s *shard) evicted(reason string) {
+	if s.onEvict != nil {
+		s.onEvict(reason)
+	}
+}
+
+// flush removes all messages and returns how many there were.
+func (s *shard) flush() int {
+	s.Lock()
+	defer s.Unlock()
+	n := len(s.m)
+	s.m = make(map[string]*list.Element)
+	s.lru.Init()
+	s.bytes = 0
+	return n
+}
+
+// stats returns the number of messages and their size.
+func (s *shard) stats() (n, bytes int) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.m), s.bytes
+}
+
+// copyElems returns copies of the messages, most recently used first.
+func (s *shard) copyElems() []elem {
+	s.Lock()
+	defer s.Unlock()
+	elems := make([]elem, 0, len(s.m))
+	for le := s.lru.Front(); le != nil; le = le.Next() {
+		e := le.Value.(*elem)
+		elems = append(elems, elem{expiration: e.expiration, msg: e.msg.Copy()})
+	}
+	return elems
+}
@@ -33,6 +33,8 @@ type Hostsfile struct {
 		mtime time.Time
 	}
 	hostMutex sync.RWMutex
+	pollMutex sync.Mutex
+	stop      chan struct{} // nil while not polling
 }
 
 // NewHostsfile returns a new Hostsfile object
@@ -49,9 +51,7 @@ func NewHostsfile(path string, config *Config) (*Hostsfile, error) {
 		return nil, err
 	}
 
-	if h.config.Poll > 0 {
-		go h.monitorHostEntries(h.config.Poll)
-	}
+	h.Start()
 
 	log.Debugf("Found host:ip pairs in %s:", h.file.path)
 	for _, hostname := range *h.hosts {
@@ -85,6 +85,85 @@ func (h *Hostsfile) FindReverse(name string) (host string, err error) {
 	return
 }
 
+// Start polls the hostsfile for changes if polling is enabled. It does
+// nothing if polling is already running, so it can be called again after Stop.
+func (h *Hostsfile) Start() {
+	if h.config.Poll <= 0 || h.file.path == "" {
+		return
+	}
+	h.pollMutex.Lock()
+	defer h.pollMutex.Unlock()
+	if h.stop != nil {
+		return
+	}
+	h.stop = make(chan struct{})
+	go h.monitorHostEntries(h.config.Poll, h.stop)
+}
+
+// Stop stops polling the hostsfile for changes
+func (h *Hostsfile) Stop() {
+	h.pollMutex.Lock()
+	defer h.pollMutex.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+// Reload reads the hostsfile again
+func (h *Hostsfile) Reload() error {
+	if h.file.path == "" {
+		return nil
+	}
+	return h.loadHostEntries()
+}
+
+// Hostsfiles combines several hostsfiles. Lookups return the result
+// of the first file with a match.
+type Hostsfiles []*Hostsfile
+
+func (hs Hostsfiles) FindHosts(name string) (addrs []net.IP, err error) {
+	for _, h := range hs {
+		if addrs, err = h.FindHosts(name); len(addrs) > 0 || err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (hs Hostsfiles) FindReverse(name string) (host string, err error) {
+	for _, h := range hs {
+		if host, err = h.FindReverse(name); host != "" || err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Start polls all hostsfiles for changes
+func (hs Hostsfiles) Start() {
+	for _, h := range hs {
+		h.Start()
+	}
+}
+
+// Stop stops polling all hostsfiles for changes
+func (hs Hostsfiles) Stop() {
+	for _, h := range hs {
+		h.Stop()
+	}
+}
+
+// Reload reads all hostsfiles again
+func (hs Hostsfiles) Reload() error {
+	for _, h := range hs {
+		if err := h.Reload(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (h *Hostsfile) loadHostEntries() error {
 	data, err := ioutil.ReadFile(h.file.path)
 	if err != nil {
@@ -98,16 +177,24 @@ func (h *Hostsfile) loadHostEntries() error {
 	return nil
 }
 
-func (h *Hostsfile) monitorHostEntries(poll int) {
+func (h *Hostsfile) monitorHostEntries(poll int, stop <-chan struct{}) {
+	h.hostMutex.RLock()
 	hf := h.file
+	h.hostMutex.RUnlock()
 
 	if hf.path == "" {
 		return
 	}
 
-	t := time.Duration(poll) * time.Second
+	ticker := time.NewTicker(time.Duration(poll) * time.Second)
+	defer ticker.Stop()
 
-	for _ = range time.Tick(t) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
 		//log.Printf("go-dnsmasq: checking %q for updates…", hf.path)
 
 		mtime, size, err := hostsFileMetadata(hf.path)
@@ -2,7 +2,9 @@ package hosts
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 )
 
@@ -197,3 +199,28 @@ func TestHostname(t *testing.T) {
 		t.Errorf("Wildcard should be %t", wildcard)
 	}
 }
+
+func TestReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("10.0.0.1 foo.local\n")
+	f.Close()
+
+	h, err := NewHostsfile(f.Name(), &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.Name(), []byte("10.0.0.2 foo.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	addrs, _ := h.FindHosts("foo.local.")
+	if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Expected 10.0.0.2 after reload, got %v", addrs)
+	}
+}
@@ -10,8 +10,8 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"reflect"
 	"runtime"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -30,13 +30,6 @@ import (
 // set at build time
 var Version = "dev"
 
-var (
-	nameservers   = []string{}
-	searchDomains = []string{}
-	hostPort      = ""
-	listen        = ""
-)
-
 var exitErr error
 
 func init() {
@@ -51,12 +44,76 @@ func main() {
 	app.Version = Version
 	app.Author, app.Email = "", ""
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config, c",
+			Value:  "",
+			Usage:  "Read the configuration from this JSON or YAML `file`, command line options take precedence",
+			EnvVar: "DNSMASQ_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "dnsmasq-conf",
+			Value:  "",
+			Usage:  "Read supported directives from this dnsmasq.conf `file`, the config file and command line options take precedence",
+			EnvVar: "DNSMASQ_DNSMASQ_CONF",
+		},
+		cli.BoolFlag{
+			Name:  "print-config",
+			Usage: "Print the effective configuration and exit",
+		},
 		cli.StringFlag{
 			Name:   "listen, l",
 			Value:  "127.0.0.1:53",
 			Usage:  "Listen on this `address` <host[:port]>",
 			EnvVar: "DNSMASQ_LISTEN",
 		},
+		cli.StringFlag{
+			Name:   "tls-listen",
+			Value:  "",
+			Usage:  "Listen for DNS-over-TLS queries on this `address` <host[:port]>",
+			EnvVar: "DNSMASQ_TLS_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "doh-listen",
+			Value:  "",
+			Usage:  "Listen for DNS-over-HTTPS queries on this `address` <host[:port]>",
+			EnvVar: "DNSMASQ_DOH_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "doh-http-listen",
+			Value:  "",
+			Usage:  "Listen for unencrypted DNS-over-HTTP queries on this `address` <host[:port]> (e.g. behind a reverse proxy)",
+			EnvVar: "DNSMASQ_DOH_HTTP_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "admin-listen",
+			Value:  "",
+			Usage:  "Serve the admin HTTP API on this `address` <host:port>",
+			EnvVar: "DNSMASQ_ADMIN_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "admin-token",
+			Value:  "",
+			Usage:  "Require this bearer `token` for the admin API, without it only loopback clients are served",
+			EnvVar: "DNSMASQ_ADMIN_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "prometheus-listen",
+			Value:  "",
+			Usage:  "Serve Prometheus metrics at /metrics on this `address` <host:port>",
+			EnvVar: "PROMETHEUS_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Value:  "",
+			Usage:  "Path to the PEM encoded certificate `file` for TLS listeners",
+			EnvVar: "DNSMASQ_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Value:  "",
+			Usage:  "Path to the PEM encoded private key `file` for TLS listeners",
+			EnvVar: "DNSMASQ_TLS_KEY",
+		},
 		cli.BoolFlag{
 			Name:   "default-resolver, d",
 			Usage:  "Update /etc/resolv.conf with the address of go-dnsmasq as nameserver",
@@ -65,14 +122,49 @@ func main() {
 		cli.StringFlag{
 			Name:   "nameservers, n",
 			Value:  "",
-			Usage:  "Comma delimited list of `nameservers` <host[:port][,host[:port]]> (supersedes resolv.conf)",
+			Usage:  "Comma delimited list of `nameservers` <host[:port][,host[:port]]>, <tls://host[:port][#servername]> or <https://host[:port]/path> (supersedes resolv.conf)",
 			EnvVar: "DNSMASQ_SERVERS",
 		},
+		cli.StringFlag{
+			Name:   "upstream-ca",
+			Value:  "",
+			Usage:  "Path to a PEM encoded CA bundle `file` used to verify DNS-over-TLS/HTTPS nameservers (defaults to system roots)",
+			EnvVar: "DNSMASQ_UPSTREAM_CA",
+		},
+		cli.StringFlag{
+			Name:   "upstream-strategy",
+			Value:  "sequential",
+			Usage:  "How to select the nameserver to query: sequential, round-robin, random, fastest or parallel",
+			EnvVar: "DNSMASQ_UPSTREAM_STRATEGY",
+		},
+		cli.IntFlag{
+			Name:   "health-interval",
+			Value:  0,
+			Usage:  "How frequently to probe upstream nameservers (`seconds`, '0' to disable)",
+			EnvVar: "DNSMASQ_HEALTH_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "health-name",
+			Value:  ".",
+			Usage:  "Domain `name` queried (type NS) to probe upstream nameservers",
+			EnvVar: "DNSMASQ_HEALTH_NAME",
+		},
+		cli.IntFlag{
+			Name:   "health-failures",
+			Value:  3,
+			Usage:  "Number of consecutive failed probes before a nameserver is skipped",
+			EnvVar: "DNSMASQ_HEALTH_FAILURES",
+		},
 		cli.StringSliceFlag{
 			Name:   "stubzones, z",
 			Usage:  "Use different nameservers for given domains <domain[,domain]/host[:port][,host[:port]]>",
 			EnvVar: "DNSMASQ_STUB",
 		},
+		cli.StringSliceFlag{
+			Name:   "stubzone-strategy",
+			Usage:  "Use a different upstream strategy for given stubzones <domain[,domain]=strategy>",
+			EnvVar: "DNSMASQ_STUB_STRATEGY",
+		},
 		cli.StringFlag{
 			Name:   "hostsfile, f",
 			Value:  "",
@@ -108,23 +200,94 @@ func main() {
 			Usage:  "Response cache `capacity` ('0' disables caching)",
 			EnvVar: "DNSMASQ_RCACHE",
 		},
+		cli.IntFlag{
+			Name:   "rcache-max-size",
+			Value:  0,
+			Usage:  "Memory limit of the response cache in `MB` ('0' for no limit)",
+			EnvVar: "DNSMASQ_RCACHE_MAX_SIZE",
+		},
 		cli.IntFlag{
 			Name:   "rcache-ttl",
 			Value:  60,
-			Usage:  "TTL in `seconds` for response cache entries",
+			Usage:  "TTL in `seconds` for cached negative responses without SOA record",
 			EnvVar: "DNSMASQ_RCACHE_TTL",
 		},
+		cli.IntFlag{
+			Name:   "min-cache-ttl",
+			Value:  0,
+			Usage:  "Cache records for at least this many `seconds`",
+			EnvVar: "DNSMASQ_MIN_CACHE_TTL",
+		},
+		cli.IntFlag{
+			Name:   "max-cache-ttl",
+			Value:  86400,
+			Usage:  "Cache records for at most this many `seconds`",
+			EnvVar: "DNSMASQ_MAX_CACHE_TTL",
+		},
+		cli.IntFlag{
+			Name:   "max-neg-cache-ttl",
+			Value:  3600,
+			Usage:  "Cache NXDOMAIN and NODATA responses for at most this many `seconds`",
+			EnvVar: "DNSMASQ_MAX_NEG_CACHE_TTL",
+		},
+		cli.IntFlag{
+			Name:   "servfail-cache-ttl",
+			Value:  0,
+			Usage:  "Cache SERVFAIL responses for this many `seconds` ('0' disables caching them)",
+			EnvVar: "DNSMASQ_SERVFAIL_CACHE_TTL",
+		},
+		cli.IntFlag{
+			Name:   "stale-cache-ttl",
+			Value:  0,
+			Usage:  "Keep expired responses for this many `seconds` to answer when the nameservers fail ('0' disables)",
+			EnvVar: "DNSMASQ_STALE_CACHE_TTL",
+		},
+		cli.DurationFlag{
+			Name:   "stale-answer-timeout",
+			Value:  0,
+			Usage:  "Answer with a stale response if the nameservers take longer than this `duration` ('0' to wait for them)",
+			EnvVar: "DNSMASQ_STALE_ANSWER_TIMEOUT",
+		},
 		cli.BoolFlag{
 			Name:   "no-rec",
 			Usage:  "Disable recursion",
 			EnvVar: "DNSMASQ_NOREC",
 		},
+		cli.IntFlag{
+			Name:   "edns-bufsize",
+			Value:  1232,
+			Usage:  "EDNS0 UDP buffer `size` advertised to clients and nameservers",
+			EnvVar: "DNSMASQ_EDNS_BUFSIZE",
+		},
+		cli.BoolFlag{
+			Name:   "no-tcp-fallback",
+			Usage:  "Don't retry queries over TCP when a nameserver returns a truncated response",
+			EnvVar: "DNSMASQ_NO_TCP_FALLBACK",
+		},
 		cli.IntFlag{
 			Name:   "fwd-ndots",
 			Value:  0,
 			Usage:  "Number of `dots` a name must have before the query is forwarded",
 			EnvVar: "DNSMASQ_FWD_NDOTS",
 		},
+		cli.IntFlag{
+			Name:   "fwd-attempts",
+			Value:  2,
+			Usage:  "Number of `attempts` to get an answer from the nameservers",
+			EnvVar: "DNSMASQ_FWD_ATTEMPTS",
+		},
+		cli.DurationFlag{
+			Name:   "fwd-timeout",
+			Value:  4 * time.Second,
+			Usage:  "Timeout of a single query to a nameserver (`duration`, e.g. '1500ms')",
+			EnvVar: "DNSMASQ_FWD_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "fwd-deadline",
+			Value:  0,
+			Usage:  "Time budget for resolving a client query including all search domains (`duration`, '0' to disable)",
+			EnvVar: "DNSMASQ_FWD_DEADLINE",
+		},
 		cli.IntFlag{
 			Name:   "ndots",
 			Value:  1,
@@ -141,6 +304,12 @@ func main() {
 			Usage:  "Bind to socket activated by Systemd (supersedes '--listen')",
 			EnvVar: "DNSMASQ_SYSTEMD",
 		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Value:  5 * time.Second,
+			Usage:  "How long to wait for queries in flight to be answered on shutdown (`duration`)",
+			EnvVar: "DNSMASQ_SHUTDOWN_TIMEOUT",
+		},
 		cli.BoolFlag{
 			Name:   "verbose",
 			Usage:  "Enable verbose logging",
@@ -151,6 +320,36 @@ func main() {
 			Usage:  "Enable syslog logging",
 			EnvVar: "DNSMASQ_SYSLOG",
 		},
+		cli.StringFlag{
+			Name:   "query-log",
+			Value:  "",
+			Usage:  "Log every client query to a `file`, 'stdout' or 'syslog'",
+			EnvVar: "DNSMASQ_QUERY_LOG",
+		},
+		cli.StringFlag{
+			Name:   "query-log-format",
+			Value:  server.QueryLogJSON,
+			Usage:  "Format of the query log: json or logfmt",
+			EnvVar: "DNSMASQ_QUERY_LOG_FORMAT",
+		},
+		cli.IntFlag{
+			Name:   "query-log-max-size",
+			Value:  0,
+			Usage:  "Rotate the query log file when it exceeds this size in `megabytes` (0 = never)",
+			EnvVar: "DNSMASQ_QUERY_LOG_MAX_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "query-log-backups",
+			Value:  3,
+			Usage:  "Number of rotated query log files to keep",
+			EnvVar: "DNSMASQ_QUERY_LOG_BACKUPS",
+		},
+		cli.StringFlag{
+			Name:   "dnstap",
+			Value:  "",
+			Usage:  "Send dnstap messages to a `file` or to a socket given as 'unix:/path'",
+			EnvVar: "DNSMASQ_DNSTAP",
+		},
 		cli.BoolFlag{
 			Name:   "multithreading",
 			Usage:  "Enable multithreading (experimental)",
@@ -158,7 +357,7 @@ func main() {
 		},
 	}
 	app.Action = func(c *cli.Context) error {
-		exitReason := make(chan error)
+		exitReason := make(chan error, 2)
 		go func() {
 			c := make(chan os.Signal, 1)
 			signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
@@ -167,14 +366,6 @@ func main() {
 			exitReason <- nil
 		}()
 
-		var enableSearch bool
-		if c.IsSet("append-search-domains") {
-			log.Info("The flag '--append-search-domains' is deprecated. Please use '--enable-search' or '-search' instead.")
-			enableSearch = c.Bool("append-search-domains")
-		} else {
-			enableSearch = c.Bool("enable-search")
-		}
-
 		if c.Bool("multithreading") {
 			runtime.GOMAXPROCS(runtime.NumCPU() + 1)
 		}
@@ -195,106 +386,28 @@ func main() {
 			log.SetFormatter(&log.TextFormatter{})
 		}
 
-		if ns := c.String("nameservers"); ns != "" {
-			for _, hostPort := range strings.Split(ns, ",") {
-				hostPort = strings.TrimSpace(hostPort)
-				if strings.HasSuffix(hostPort, "]") {
-					hostPort += ":53"
-				} else if !strings.Contains(hostPort, ":") {
-					hostPort += ":53"
-				}
-				if err := validateHostPort(hostPort); err != nil {
-					log.Fatalf("Nameserver is invalid: %s", err)
-				}
-
-				nameservers = append(nameservers, hostPort)
+		if c.Bool("print-config") {
+			config, err := loadConfig(c)
+			if err != nil {
+				log.Fatal(err.Error())
 			}
-		}
-
-		if sd := c.String("search-domains"); sd != "" {
-			for _, domain := range strings.Split(sd, ",") {
-				if dns.CountLabel(domain) < 2 {
-					log.Fatalf("Search domain must have at least one dot in name: %s", domain)
-				}
-				domain = strings.TrimSpace(domain)
-				domain = dns.Fqdn(strings.ToLower(domain))
-				searchDomains = append(searchDomains, domain)
+			config.AdminToken = ""
+			out, err := server.FormatConfig(config)
+			if err != nil {
+				log.Fatal(err.Error())
 			}
-		}
-
-		listen = c.String("listen")
-		if strings.HasSuffix(listen, "]") {
-			listen += ":53"
-		} else if !strings.Contains(listen, ":") {
-			listen += ":53"
-		}
-
-		if err := validateHostPort(listen); err != nil {
-			log.Fatalf("Listen address is invalid: %s", err)
-		}
-
-		config := &server.Config{
-			DnsAddr:         listen,
-			DefaultResolver: c.Bool("default-resolver"),
-			Nameservers:     nameservers,
-			Systemd:         c.Bool("systemd"),
-			SearchDomains:   searchDomains,
-			EnableSearch:    enableSearch,
-			Hostsfile:       c.String("hostsfile"),
-			PollInterval:    c.Int("hostsfile-poll"),
-			RoundRobin:      c.Bool("round-robin"),
-			NoRec:           c.Bool("no-rec"),
-			FwdNdots:        c.Int("fwd-ndots"),
-			Ndots:           c.Int("ndots"),
-			ReadTimeout:     2 * time.Second,
-			RCache:          c.Int("rcache"),
-			RCacheTtl:       c.Int("rcache-ttl"),
-			Verbose:         c.Bool("verbose"),
+			fmt.Println(string(out))
+			return nil
 		}
 
 		resolvconf.Clean()
-		if err := server.ResolvConf(config, c); err != nil {
-			if !os.IsNotExist(err) {
-				log.Warnf("Error parsing resolv.conf: %s", err.Error())
-			}
-		}
-
-		if err := server.CheckConfig(config); err != nil {
+		config, err := loadConfig(c)
+		if err != nil {
 			log.Fatal(err.Error())
 		}
 
-		if stubzones := c.StringSlice("stubzones"); len(stubzones) > 0 {
-			stubmap := make(map[string][]string)
-			for _, stubzone := range stubzones {
-				segments := strings.Split(stubzone, "/")
-				if len(segments) != 2 || len(segments[0]) == 0 || len(segments[1]) == 0 {
-					log.Fatalf("Invalid value for --stubzones")
-				}
-
-				hosts := strings.Split(segments[1], ",")
-				for _, hostPort := range hosts {
-					hostPort = strings.TrimSpace(hostPort)
-					if strings.HasSuffix(hostPort, "]") {
-						hostPort += ":53"
-					} else if !strings.Contains(hostPort, ":") {
-						hostPort += ":53"
-					}
-
-					if err := validateHostPort(hostPort); err != nil {
-						log.Fatalf("Stubzone server address is invalid: %s", err)
-					}
-
-					for _, sdomain := range strings.Split(segments[0], ",") {
-						if dns.CountLabel(sdomain) < 1 {
-							log.Fatalf("Stubzone domain is not a fully-qualified domain name: %s", sdomain)
-						}
-						sdomain = strings.TrimSpace(sdomain)
-						sdomain = dns.Fqdn(sdomain)
-						stubmap[sdomain] = append(stubmap[sdomain], hostPort)
-					}
-				}
-			}
-			config.Stub = &stubmap
+		if config.Verbose {
+			log.SetLevel(log.DebugLevel)
 		}
 
 		log.Infof("Starting go-dnsmasq server %s", Version)
@@ -303,23 +416,21 @@ func main() {
 			log.Infof("Search domains: %v", config.SearchDomains)
 		}
 
-		hf, err := hosts.NewHostsfile(config.Hostsfile, &hosts.Config{
-			Poll:    config.PollInterval,
-			Verbose: config.Verbose,
-		})
+		hf, err := newHostfile(config)
 		if err != nil {
 			log.Fatalf("Error loading hostsfile: %s", err)
 		}
 
 		s := server.New(hf, config, Version)
 
-		defer s.Stop()
-
-		stats.Collect()
+		if err := stats.Collect(config.PrometheusAddr); err != nil {
+			log.Fatalf("Failed to start metrics reporting: %s", err)
+		}
 
+		var resolverAddr string
 		if config.DefaultResolver {
-			address, _, _ := net.SplitHostPort(config.DnsAddr)
-			err := resolvconf.StoreAddress(address)
+			resolverAddr, _, _ = net.SplitHostPort(config.DnsAddr)
+			err := resolvconf.StoreAddress(resolverAddr)
 			if err != nil {
 				log.Warnf("Failed to register as default nameserver: %s", err)
 			}
@@ -330,15 +441,25 @@ func main() {
 			}()
 		}
 
+		// Reload the configuration on SIGHUP
 		go func() {
-			if err := s.Run(); err != nil {
-				exitReason <- err
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				log.Info("Reloading configuration")
+				reload(c, s, resolverAddr)
 			}
 		}()
 
+		go func() {
+			exitReason <- s.Run()
+		}()
+
 		exitErr = <-exitReason
+		s.Stop()
+		stats.Stop()
 		if exitErr != nil {
-			log.Fatalf("Server error: %s", err)
+			log.Fatalf("Server error: %s", exitErr)
 		}
 
 		return nil
@@ -347,17 +468,395 @@ func main() {
 	app.Run(os.Args)
 }
 
-func validateHostPort(hostPort string) error {
-	host, port, err := net.SplitHostPort(hostPort)
+// reload re-reads the configuration, /etc/resolv.conf and the hostsfile and
+// applies them to the running server. If resolverAddr is set it is registered
+// as default nameserver again after reading resolv.conf.
+func reload(c *cli.Context, s interface {
+	Reload(*server.Config, server.Hostfile)
+}, resolverAddr string) {
+	resolvconf.Clean()
+	config, err := loadConfig(c)
+
+	if resolverAddr != "" {
+		if err := resolvconf.StoreAddress(resolverAddr); err != nil {
+			log.Warnf("Failed to register as default nameserver: %s", err)
+		}
+	}
+
 	if err != nil {
-		return err
+		log.Errorf("Failed to reload configuration: %s", err)
+		return
+	}
+
+	hf, err := newHostfile(config)
+	if err != nil {
+		log.Errorf("Failed to reload hostsfile: %s", err)
+		return
+	}
+
+	if config.Verbose {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	s.Reload(config, hf)
+}
+
+// newHostfile loads the hostsfile and the additional hostsfiles.
+func newHostfile(config *server.Config) (server.Hostfile, error) {
+	hostsConfig := &hosts.Config{
+		Poll:    config.PollInterval,
+		Verbose: config.Verbose,
+	}
+	hf, err := hosts.NewHostsfile(config.Hostsfile, hostsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.AddnHosts) == 0 {
+		return hf, nil
+	}
+
+	hfs := hosts.Hostsfiles{hf}
+	for _, path := range config.AddnHosts {
+		hf, err := hosts.NewHostsfile(path, hostsConfig)
+		if err != nil {
+			hfs.Stop()
+			return nil, err
+		}
+		hfs = append(hfs, hf)
+	}
+	return hfs, nil
+}
+
+// configFlags maps Config fields to the command line options setting them.
+var configFlags = map[string][]string{
+	"DnsAddr":             {"listen"},
+	"TLSAddr":             {"tls-listen"},
+	"DoHAddr":             {"doh-listen"},
+	"DoHHTTPAddr":         {"doh-http-listen"},
+	"AdminAddr":           {"admin-listen"},
+	"AdminToken":          {"admin-token"},
+	"PrometheusAddr":      {"prometheus-listen"},
+	"TLSCertFile":         {"tls-cert"},
+	"TLSKeyFile":          {"tls-key"},
+	"DefaultResolver":     {"default-resolver"},
+	"Nameservers":         {"nameservers"},
+	"UpstreamCAFile":      {"upstream-ca"},
+	"UpstreamStrategy":    {"upstream-strategy"},
+	"HealthCheckInterval": {"health-interval"},
+	"HealthCheckName":     {"health-name"},
+	"HealthCheckFailures": {"health-failures"},
+	"Stub":                {"stubzones"},
+	"StubStrategy":        {"stubzone-strategy"},
+	"Hostsfile":           {"hostsfile"},
+	"PollInterval":        {"hostsfile-poll"},
+	"SearchDomains":       {"search-domains"},
+	"EnableSearch":        {"enable-search", "append-search-domains"},
+	"RCache":              {"rcache"},
+	"RCacheMaxSize":       {"rcache-max-size"},
+	"RCacheTtl":           {"rcache-ttl"},
+	"MinCacheTtl":         {"min-cache-ttl"},
+	"MaxCacheTtl":         {"max-cache-ttl"},
+	"MaxNegCacheTtl":      {"max-neg-cache-ttl"},
+	"ServfailCacheTtl":    {"servfail-cache-ttl"},
+	"StaleCacheTtl":       {"stale-cache-ttl"},
+	"StaleAnswerTimeout":  {"stale-answer-timeout"},
+	"NoRec":               {"no-rec"},
+	"EdnsBufSize":         {"edns-bufsize"},
+	"NoTCPFallback":       {"no-tcp-fallback"},
+	"FwdNdots":            {"fwd-ndots"},
+	"FwdAttempts":         {"fwd-attempts"},
+	"FwdTimeout":          {"fwd-timeout"},
+	"FwdDeadline":         {"fwd-deadline"},
+	"Ndots":               {"ndots"},
+	"RoundRobin":          {"round-robin"},
+	"Systemd":             {"systemd"},
+	"ShutdownTimeout":     {"shutdown-timeout"},
+	"Verbose":             {"verbose"},
+	"QueryLog":            {"query-log"},
+	"QueryLogFormat":      {"query-log-format"},
+	"QueryLogMaxSize":     {"query-log-max-size"},
+	"QueryLogBackups":     {"query-log-backups"},
+	"Dnstap":              {"dnstap"},
+}
+
+// loadConfig builds and checks the server configuration from the config file,
+// the command line options and /etc/resolv.conf. Options given on the command
+// line or by environment variables take precedence over the config file.
+func loadConfig(c *cli.Context) (*server.Config, error) {
+	config, err := configFromFlags(c)
+	if err != nil {
+		return nil, err
+	}
+
+	keepNdots := c.IsSet("ndots")
+	if path := c.String("dnsmasq-conf"); path != "" {
+		dnsmasqConfig := new(server.Config)
+		if err := server.ReadDnsmasqConf(path, dnsmasqConfig); err != nil {
+			return nil, fmt.Errorf("Error reading dnsmasq.conf: %s", err)
+		}
+		mergeConfig(config, dnsmasqConfig, nonZeroFields(dnsmasqConfig), c)
+	}
+	if path := c.String("config"); path != "" {
+		fileConfig := new(server.Config)
+		fields, err := server.ReadConfigFile(path, fileConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading config file %s: %s", path, err)
+		}
+		mergeConfig(config, fileConfig, fields, c)
+		for _, field := range fields {
+			keepNdots = keepNdots || field == "Ndots"
+		}
+	}
+
+	if err := normalizeConfig(config); err != nil {
+		return nil, err
+	}
+
+	if err := server.ResolvConf(config, keepNdots); err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Error parsing resolv.conf: %s", err.Error())
+		}
+	}
+
+	if err := server.CheckConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// mergeConfig sets the given fields of config to their values in fileConfig,
+// unless they are set on the command line or by environment variables.
+func mergeConfig(config, fileConfig *server.Config, fields []string, c *cli.Context) {
+	dst, src := reflect.ValueOf(config).Elem(), reflect.ValueOf(fileConfig).Elem()
+	for _, name := range fields {
+		set := false
+		for _, flag := range configFlags[name] {
+			set = set || c.IsSet(flag)
+		}
+		if !set {
+			dst.FieldByName(name).Set(src.FieldByName(name))
+		}
+	}
+}
+
+// nonZeroFields returns the names of the fields of config that are set. The
+// dnsmasq.conf directives don't map to fields one to one, so the fields they
+// set to their zero value can't be told apart from those not given.
+func nonZeroFields(config *server.Config) []string {
+	var fields []string
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Field(i).IsZero() {
+			fields = append(fields, v.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
+
+// configFromFlags returns the configuration given by the command line options.
+func configFromFlags(c *cli.Context) (*server.Config, error) {
+	var nameservers, searchDomains []string
+
+	var enableSearch bool
+	if c.IsSet("append-search-domains") {
+		log.Info("The flag '--append-search-domains' is deprecated. Please use '--enable-search' or '-search' instead.")
+		enableSearch = c.Bool("append-search-domains")
+	} else {
+		enableSearch = c.Bool("enable-search")
 	}
-	if ip := net.ParseIP(host); ip == nil {
-		return fmt.Errorf("Bad IP address: %s", host)
+
+	if ns := c.String("nameservers"); ns != "" {
+		nameservers = strings.Split(ns, ",")
+	}
+
+	if sd := c.String("search-domains"); sd != "" {
+		searchDomains = strings.Split(sd, ",")
+	}
+
+	ednsBufSize := c.Int("edns-bufsize")
+	if ednsBufSize < 512 || ednsBufSize > 65535 {
+		return nil, fmt.Errorf("EDNS buffer size must be between 512 and 65535: %d", ednsBufSize)
+	}
+
+	config := &server.Config{
+		DnsAddr:             c.String("listen"),
+		TLSAddr:             c.String("tls-listen"),
+		DoHAddr:             c.String("doh-listen"),
+		DoHHTTPAddr:         c.String("doh-http-listen"),
+		AdminAddr:           c.String("admin-listen"),
+		AdminToken:          c.String("admin-token"),
+		PrometheusAddr:      c.String("prometheus-listen"),
+		TLSCertFile:         c.String("tls-cert"),
+		TLSKeyFile:          c.String("tls-key"),
+		DefaultResolver:     c.Bool("default-resolver"),
+		Nameservers:         nameservers,
+		UpstreamCAFile:      c.String("upstream-ca"),
+		UpstreamStrategy:    c.String("upstream-strategy"),
+		HealthCheckInterval: c.Int("health-interval"),
+		HealthCheckName:     c.String("health-name"),
+		HealthCheckFailures: c.Int("health-failures"),
+		Systemd:             c.Bool("systemd"),
+		SearchDomains:       searchDomains,
+		EnableSearch:        enableSearch,
+		Hostsfile:           c.String("hostsfile"),
+		PollInterval:        c.Int("hostsfile-poll"),
+		RoundRobin:          c.Bool("round-robin"),
+		NoRec:               c.Bool("no-rec"),
+		FwdNdots:            c.Int("fwd-ndots"),
+		Ndots:               c.Int("ndots"),
+		ReadTimeout:         2 * time.Second,
+		EdnsBufSize:         uint16(ednsBufSize),
+		NoTCPFallback:       c.Bool("no-tcp-fallback"),
+		FwdAttempts:         c.Int("fwd-attempts"),
+		FwdTimeout:          c.Duration("fwd-timeout"),
+		FwdDeadline:         c.Duration("fwd-deadline"),
+		ShutdownTimeout:     c.Duration("shutdown-timeout"),
+		RCache:              c.Int("rcache"),
+		RCacheMaxSize:       c.Int("rcache-max-size"),
+		RCacheTtl:           c.Int("rcache-ttl"),
+		MinCacheTtl:         c.Int("min-cache-ttl"),
+		MaxCacheTtl:         c.Int("max-cache-ttl"),
+		MaxNegCacheTtl:      c.Int("max-neg-cache-ttl"),
+		ServfailCacheTtl:    c.Int("servfail-cache-ttl"),
+		StaleCacheTtl:       c.Int("stale-cache-ttl"),
+		StaleAnswerTimeout:  c.Duration("stale-answer-timeout"),
+		Verbose:             c.Bool("verbose"),
+		QueryLog:            c.String("query-log"),
+		QueryLogFormat:      c.String("query-log-format"),
+		QueryLogMaxSize:     c.Int("query-log-max-size"),
+		QueryLogBackups:     c.Int("query-log-backups"),
+		Dnstap:              c.String("dnstap"),
 	}
 
-	if p, _ := strconv.Atoi(port); p < 1 || p > 65535 {
-		return fmt.Errorf("Bad port number %s", port)
+	if stubzones := c.StringSlice("stubzones"); len(stubzones) > 0 {
+		stubmap := make(map[string][]string)
+		for _, stubzone := range stubzones {
+			segments := strings.SplitN(stubzone, "/", 2)
+			if len(segments) != 2 || len(segments[0]) == 0 || len(segments[1]) == 0 {
+				return nil, fmt.Errorf("Invalid value for --stubzones")
+			}
+
+			hosts := strings.Split(segments[1], ",")
+			for _, sdomain := range strings.Split(segments[0], ",") {
+				stubmap[sdomain] = append(stubmap[sdomain], hosts...)
+			}
+		}
+		config.Stub = &stubmap
+	}
+
+	if strategies := c.StringSlice("stubzone-strategy"); len(strategies) > 0 {
+		config.StubStrategy = make(map[string]string)
+		for _, s := range strategies {
+			segments := strings.SplitN(s, "=", 2)
+			if len(segments) != 2 || len(segments[0]) == 0 || !server.ValidStrategy(segments[1]) {
+				return nil, fmt.Errorf("Invalid value for --stubzone-strategy: %s", s)
+			}
+			for _, sdomain := range strings.Split(segments[0], ",") {
+				config.StubStrategy[sdomain] = segments[1]
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// normalizeConfig validates the addresses and domains in the configuration
+// and brings them into canonical form.
+func normalizeConfig(config *server.Config) error {
+	config.DnsAddr = server.AddDefaultPort(config.DnsAddr, "53")
+	if err := server.ValidateHostPort(config.DnsAddr); err != nil {
+		return fmt.Errorf("Listen address is invalid: %s", err)
+	}
+
+	if config.TLSAddr != "" {
+		config.TLSAddr = server.AddDefaultPort(config.TLSAddr, "853")
+		if err := server.ValidateHostPort(config.TLSAddr); err != nil {
+			return fmt.Errorf("TLS listen address is invalid: %s", err)
+		}
+	}
+
+	if config.DoHAddr != "" {
+		config.DoHAddr = server.AddDefaultPort(config.DoHAddr, "443")
+		if err := server.ValidateHostPort(config.DoHAddr); err != nil {
+			return fmt.Errorf("DoH listen address is invalid: %s", err)
+		}
+	}
+
+	if config.DoHHTTPAddr != "" {
+		config.DoHHTTPAddr = server.AddDefaultPort(config.DoHHTTPAddr, "80")
+		if err := server.ValidateHostPort(config.DoHHTTPAddr); err != nil {
+			return fmt.Errorf("DoH HTTP listen address is invalid: %s", err)
+		}
 	}
+
+	if config.AdminAddr != "" {
+		if err := server.ValidateHostPort(config.AdminAddr); err != nil {
+			return fmt.Errorf("Admin listen address is invalid: %s", err)
+		}
+	}
+
+	if config.PrometheusAddr != "" {
+		if err := server.ValidateHostPort(config.PrometheusAddr); err != nil {
+			return fmt.Errorf("Prometheus listen address is invalid: %s", err)
+		}
+	}
+
+	for i, hostPort := range config.Nameservers {
+		hostPort, err := server.ParseNameserver(hostPort)
+		if err != nil {
+			return fmt.Errorf("Nameserver is invalid: %s", err)
+		}
+		config.Nameservers[i] = hostPort
+	}
+
+	for i, domain := range config.SearchDomains {
+		if dns.CountLabel(domain) < 2 {
+			return fmt.Errorf("Search domain must have at least one dot in name: %s", domain)
+		}
+		domain = strings.TrimSpace(domain)
+		config.SearchDomains[i] = dns.Fqdn(strings.ToLower(domain))
+	}
+
+	if config.Stub != nil {
+		stubmap := make(map[string][]string)
+		for sdomain, hosts := range *config.Stub {
+			if dns.CountLabel(sdomain) < 1 {
+				return fmt.Errorf("Stubzone domain is not a fully-qualified domain name: %s", sdomain)
+			}
+			sdomain = dns.Fqdn(strings.TrimSpace(sdomain))
+			for _, hostPort := range hosts {
+				hostPort, err := server.ParseNameserver(hostPort)
+				if err != nil {
+					return fmt.Errorf("Stubzone server address is invalid: %s", err)
+				}
+				stubmap[sdomain] = append(stubmap[sdomain], hostPort)
+			}
+		}
+		config.Stub = &stubmap
+	}
+
+	if config.Addresses != nil {
+		addresses := make(map[string][]string)
+		for domain, ips := range config.Addresses {
+			domain = dns.Fqdn(strings.ToLower(strings.TrimSpace(domain)))
+			addresses[domain] = append(addresses[domain], ips...)
+		}
+		config.Addresses = addresses
+	}
+
+	for i, domain := range config.LocalDomains {
+		config.LocalDomains[i] = dns.Fqdn(strings.ToLower(strings.TrimSpace(domain)))
+	}
+
+	if config.StubStrategy != nil {
+		strategies := make(map[string]string)
+		for sdomain, strategy := range config.StubStrategy {
+			strategies[dns.Fqdn(strings.TrimSpace(sdomain))] = strategy
+		}
+		config.StubStrategy = strategies
+	}
+
 	return nil
 }
@@ -0,0 +1,449 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const adminStubsPath = "/stubs/"
+
+// reloader is implemented by hostsfiles that can be read again.
+type reloader interface {
+	Reload() error
+}
+
+// adminMux returns the HTTP handler of the admin API.
+func (s *server) adminMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.adminHealthz)
+	mux.HandleFunc("/cache", s.adminCache)
+	mux.HandleFunc("/hosts/reload", s.adminReloadHosts)
+	mux.HandleFunc("/upstreams", s.adminUpstreams)
+	mux.HandleFunc("/config", s.adminConfig)
+	mux.HandleFunc("/stubs", s.adminStubs)
+	mux.HandleFunc(adminStubsPath, s.adminStub)
+	return s.adminAuth(mux)
+}
+
+// adminAuth serves requests with the bearer token of the AdminToken option
+// or, if it isn't set, requests from loopback clients. The health check is
+// served to everyone, e.g. for readiness probes.
+func (s *server) adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || s.authorized(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorized returns true if the request has the admin token or, without a
+// token, comes from a loopback client. Otherwise it responds with an error.
+func (s *server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if token := s.config().AdminToken; token != "" {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-dnsmasq"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err != nil || !net.ParseIP(host).IsLoopback() {
+		http.Error(w, "forbidden, set an admin token to serve non-loopback clients", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adminHealthz forwards a query for the health check name to the nameservers
+// and reports whether an answer was obtained. The cache is bypassed and the
+// query isn't counted as a client query. Authorized requests can ask for
+// another name and type with the 'name' and 'type' parameters.
+func (s *server) adminHealthz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	if !s.running() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "stopped"})
+		return
+	}
+
+	name, qtype := s.config().HealthCheckName, dns.TypeNS
+	n, t := r.URL.Query().Get("name"), r.URL.Query().Get("type")
+	if (n != "" || t != "") && !s.authorized(w, r) {
+		return
+	}
+	if n != "" {
+		name = dns.Fqdn(n)
+		qtype = dns.TypeA
+	}
+	if t != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t)]; !ok {
+			http.Error(w, fmt.Sprintf("unknown type '%s'", t), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		http.Error(w, fmt.Sprintf("invalid name '%s'", name), http.StatusBadRequest)
+		return
+	}
+
+	result := map[string]interface{}{
+		"name": name,
+		"type": dns.TypeToString[qtype],
+	}
+	if _, ok := s.stubZone(name); !ok && len(s.config().Nameservers) == 0 {
+		result["status"] = "no nameservers"
+		writeJSON(w, http.StatusServiceUnavailable, result)
+		return
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(s.config().EdnsBufSize, false)
+	ctx := r.Context()
+	if s.config().FwdDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config().FwdDeadline)
+		defer cancel()
+	}
+	start := time.Now()
+	m, err := s.forwardQuery(ctx, req, false)
+	result["duration_ms"] = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result["status"] = "no response"
+		result["error"] = err.Error()
+		writeJSON(w, http.StatusServiceUnavailable, result)
+		return
+	}
+	result["rcode"] = rcodeLabel(m.Rcode)
+	result["answers"] = len(m.Answer)
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		result["status"] = "failed"
+		writeJSON(w, http.StatusServiceUnavailable, result)
+		return
+	}
+	result["status"] = "ok"
+	writeJSON(w, http.StatusOK, result)
+}
+
+type cacheEntry struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Rcode     string `json:"rcode"`
+	Answers   int    `json:"answers"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// adminCache lists the cached responses, optionally only those for the
+// 'name' parameter, or flushes the cache on DELETE.
+func (s *server) adminCache(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		n := s.rcache.Flush()
+		log.Infof("Flushed %d responses from the cache", n)
+		writeJSON(w, http.StatusOK, map[string]int{"flushed": n})
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name != "" {
+		name = dns.Fqdn(strings.ToLower(name))
+	}
+	entries := []cacheEntry{}
+	now := time.Now()
+	s.rcache.Each(func(m *dns.Msg, expiration time.Time) {
+		if len(m.Question) == 0 || (name != "" && strings.ToLower(m.Question[0].Name) != name) {
+			return
+		}
+		entries = append(entries, cacheEntry{
+			Name:      m.Question[0].Name,
+			Type:      dns.TypeToString[m.Question[0].Qtype],
+			Rcode:     rcodeLabel(m.Rcode),
+			Answers:   len(m.Answer),
+			ExpiresIn: int(expiration.Sub(now).Seconds()),
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"capacity": s.rcache.Capacity(),
+		"size":     s.rcache.Len(),
+		"bytes":    s.rcache.Bytes(),
+		"entries":  entries,
+	})
+}
+
+// adminReloadHosts reads the hostsfiles again.
+func (s *server) adminReloadHosts(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	h, ok := s.hostfile().(reloader)
+	if !ok {
+		http.Error(w, "hostsfile can't be reloaded", http.StatusNotImplemented)
+		return
+	}
+	if err := h.Reload(); err != nil {
+		log.Errorf("Failed to reload hostsfile: %s", err)
+		http.Error(w, fmt.Sprintf("failed to reload hostsfile: %s", err), http.StatusInternalServerError)
+		return
+	}
+	log.Info("Reloaded hostsfile")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+type upstreamStatus struct {
+	Address  string     `json:"address"`
+	Zones    []string   `json:"zones"`
+	Up       bool       `json:"up"`
+	Failures int        `json:"failures"`
+	Since    *time.Time `json:"since,omitempty"`
+	SRTT     float64    `json:"srtt_ms"`
+}
+
+// adminUpstreams lists the nameservers with their health check state and
+// smoothed response time.
+func (s *server) adminUpstreams(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	config := s.config()
+	zones := make(map[string][]string)
+	for _, ns := range config.Nameservers {
+		zones[ns] = append(zones[ns], ".")
+	}
+	for zone, nservers := range stubZones(config) {
+		for _, ns := range nservers {
+			zones[ns] = append(zones[ns], zone)
+		}
+	}
+
+	upstreams := []upstreamStatus{}
+	for _, addr := range s.allUpstreams() {
+		u := upstreamStatus{Address: addr, Zones: zones[addr], Up: true}
+		sort.Strings(u.Zones)
+		s.healthMu.RLock()
+		if h, ok := s.health[addr]; ok {
+			since := h.since
+			u.Up, u.Failures, u.Since = !h.down, h.failures, &since
+		}
+		s.healthMu.RUnlock()
+		s.rttMu.RLock()
+		u.SRTT = float64(s.srtt[addr]) / float64(time.Millisecond)
+		s.rttMu.RUnlock()
+		upstreams = append(upstreams, u)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"health_checks": config.HealthCheckInterval > 0,
+		"upstreams":     upstreams,
+	})
+}
+
+// adminConfig shows the effective configuration in the config file format.
+func (s *server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	config := *s.config()
+	config.AdminToken = ""
+	out, err := FormatConfig(&config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(out, '\n'))
+}
+
+type adminStubZone struct {
+	Nameservers []string `json:"nameservers"`
+	Strategy    string   `json:"strategy,omitempty"`
+}
+
+// adminStubs lists the stub zones.
+func (s *server) adminStubs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	config := s.config()
+	stubs := make(map[string]adminStubZone)
+	for zone, nservers := range stubZones(config) {
+		stubs[zone] = adminStubZone{nservers, config.StubStrategy[zone]}
+	}
+	writeJSON(w, http.StatusOK, stubs)
+}
+
+// adminStub shows, adds or replaces, or removes the stub zone named in the path.
+func (s *server) adminStub(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	zone := strings.ToLower(strings.TrimPrefix(r.URL.Path, adminStubsPath))
+	if _, ok := dns.IsDomainName(zone); !ok || zone == "" {
+		http.Error(w, fmt.Sprintf("invalid zone '%s'", zone), http.StatusBadRequest)
+		return
+	}
+	zone = dns.Fqdn(zone)
+
+	switch r.Method {
+	case http.MethodGet:
+		config := s.config()
+		nservers, ok := stubZones(config)[zone]
+		if !ok {
+			http.Error(w, fmt.Sprintf("no stub zone '%s'", zone), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, adminStubZone{nservers, config.StubStrategy[zone]})
+
+	case http.MethodPut:
+		var stub adminStubZone
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&stub); err != nil {
+			http.Error(w, fmt.Sprintf("malformed stub zone: %s", err), http.StatusBadRequest)
+			return
+		}
+		if len(stub.Nameservers) == 0 {
+			http.Error(w, "stub zone needs at least one nameserver", http.StatusBadRequest)
+			return
+		}
+		for i, ns := range stub.Nameservers {
+			hostPort, err := ParseNameserver(ns)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid nameserver '%s': %s", ns, err), http.StatusBadRequest)
+				return
+			}
+			stub.Nameservers[i] = hostPort
+		}
+		if stub.Strategy != "" && !ValidStrategy(stub.Strategy) {
+			http.Error(w, fmt.Sprintf("unknown strategy '%s'", stub.Strategy), http.StatusBadRequest)
+			return
+		}
+		s.updateStubs(func(stubs map[string][]string, strategies map[string]string) {
+			stubs[zone] = stub.Nameservers
+			delete(strategies, zone)
+			if stub.Strategy != "" {
+				strategies[zone] = stub.Strategy
+			}
+		})
+		log.Infof("Set stub zone %s: %v", zone, stub.Nameservers)
+		s.purgeZone(zone)
+		writeJSON(w, http.StatusOK, stub)
+
+	case http.MethodDelete:
+		found := false
+		s.updateStubs(func(stubs map[string][]string, strategies map[string]string) {
+			_, found = stubs[zone]
+			delete(stubs, zone)
+			delete(strategies, zone)
+		})
+		if !found {
+			http.Error(w, fmt.Sprintf("no stub zone '%s'", zone), http.StatusNotFound)
+			return
+		}
+		log.Infof("Removed stub zone %s", zone)
+		s.purgeZone(zone)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// updateStubs replaces the config with a copy in which f changed the stub
+// zones and their strategies.
+func (s *server) updateStubs(f func(stubs map[string][]string, strategies map[string]string)) {
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+
+	config := *s.config()
+	stubs := make(map[string][]string)
+	for zone, nservers := range stubZones(&config) {
+		stubs[zone] = nservers
+	}
+	strategies := make(map[string]string)
+	for zone, strategy := range config.StubStrategy {
+		strategies[zone] = strategy
+	}
+	f(stubs, strategies)
+	config.Stub, config.StubStrategy = &stubs, strategies
+	s.conf.Store(&config)
+}
+
+// purgeZone removes the cached responses for names in zone, they were
+// resolved by other nameservers before the stub zone changed.
+func (s *server) purgeZone(zone string) {
+	n := s.rcache.RemoveFunc(func(m *dns.Msg) bool {
+		return len(m.Question) > 0 && dns.IsSubDomain(zone, strings.ToLower(m.Question[0].Name))
+	})
+	if n > 0 {
+		log.Infof("Removed %d cached responses for %s", n, zone)
+	}
+}
+
+// stubZones returns the stub zones of config, none if they aren't set.
+func stubZones(config *Config) map[string][]string {
+	if config.Stub == nil {
+		return nil
+	}
+	return *config.Stub
+}
+
+// running returns true if the server is running and not being stopped.
+func (s *server) running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stop != nil && !isClosed(s.stop)
+}
+
+// track adds a goroutine to those Stop waits for and returns true, unless the
+// server is being stopped.
+func (s *server) track() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil && isClosed(s.stop) {
+		return false
+	}
+	s.group.Add(1)
+	return true
+}
+
+// allowMethods returns true if the request method is one of methods,
+// otherwise it responds with an error.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(out, '\n'))
+}
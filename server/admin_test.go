@@ -0,0 +1,356 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/cache"
+)
+
+// reloadHostfile counts calls to Reload.
+type reloadHostfile struct {
+	testHostfile
+	reloads int
+}
+
+func (h *reloadHostfile) Reload() error {
+	h.reloads++
+	return nil
+}
+
+func newTestAdminServer(t *testing.T) (*server, *httptest.Server) {
+	config := &Config{
+		DnsAddr:     "127.0.0.1:0",
+		Nameservers: []string{"192.0.2.53:53"},
+		RCache:      10,
+		RCacheTtl:   60,
+		Ndots:       1,
+		Stub:        &map[string][]string{"stub.example.": {"192.0.2.1:53"}},
+	}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	hosts := &reloadHostfile{testHostfile: testHostfile{"admin.example.": {net.ParseIP("192.0.2.1")}}}
+	s := New(hosts, config, "test")
+	s.stop = make(chan struct{})
+	return s, httptest.NewServer(s.adminMux())
+}
+
+func adminRequest(t *testing.T, method, url, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// serveTestUpstream answers queries on UDP with an A or NS record until the
+// returned function is called.
+func serveTestUpstream(t *testing.T) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen on udp: %v", err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype == dns.TypeNS {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 86400 IN NS a.root-servers.net.")
+			m.Answer = []dns.RR{rr}
+		} else {
+			m.Answer = []dns.RR{newA(req.Question[0].Name + " 60 IN A 192.0.2.1")}
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestAdminHealthz(t *testing.T) {
+	s, ts := newTestAdminServer(t)
+	defer ts.Close()
+	addr, shutdown := serveTestUpstream(t)
+	s.config().Nameservers = []string{addr}
+
+	answers := new(testVec)
+	StatsAnswerCount = answers
+	defer func() { StatsAnswerCount = nopVec{} }()
+
+	var result map[string]interface{}
+	if code := adminRequest(t, "GET", ts.URL+"/healthz", "", &result); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if result["status"] != "ok" || result["answers"] != 1.0 || result["type"] != "NS" {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if code := adminRequest(t, "GET", ts.URL+"/healthz?name=host.example&type=aaaa", "", &result); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if result["name"] != "host.example." || result["type"] != "AAAA" {
+		t.Fatalf("unexpected result: %v", result)
+	}
+	if code := adminRequest(t, "GET", ts.URL+"/healthz?name=host.example&type=BOGUS", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an unknown type, got %d", code)
+	}
+
+	// The probes are neither cached nor counted as client queries
+	if n := s.rcache.Len(); n != 0 {
+		t.Fatalf("expected no cached responses, got %d", n)
+	}
+	if len(answers.labels) != 0 {
+		t.Fatalf("expected no answers counted, got %v", answers.labels)
+	}
+
+	shutdown()
+	s.config().FwdTimeout = 100 * time.Millisecond
+	if code := adminRequest(t, "GET", ts.URL+"/healthz", "", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 with the nameserver down, got %d", code)
+	}
+
+	close(s.stop)
+	if code := adminRequest(t, "GET", ts.URL+"/healthz", "", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 when stopped, got %d", code)
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	s, ts := newTestAdminServer(t)
+	defer ts.Close()
+
+	for _, name := range []string{"a.example.", "b.example."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Answer = []dns.RR{newA(name + " 3600 IN A 192.0.2.1")}
+		s.rcache.InsertMessage(cache.Key(m.Question[0], false, false), m)
+	}
+
+	var result struct {
+		Size    int
+		Entries []cacheEntry
+	}
+	if code := adminRequest(t, "GET", ts.URL+"/cache?name=B.example", "", &result); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if result.Size != 2 || len(result.Entries) != 1 || result.Entries[0].Name != "b.example." ||
+		result.Entries[0].Type != "A" || result.Entries[0].Answers != 1 || result.Entries[0].ExpiresIn <= 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	var flushed map[string]int
+	if code := adminRequest(t, "DELETE", ts.URL+"/cache", "", &flushed); code != http.StatusOK || flushed["flushed"] != 2 {
+		t.Fatalf("expected 2 flushed responses, got %d %v", code, flushed)
+	}
+	if s.rcache.Len() != 0 {
+		t.Fatalf("expected an empty cache, got %d responses", s.rcache.Len())
+	}
+	if code := adminRequest(t, "POST", ts.URL+"/cache", "", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", code)
+	}
+}
+
+func TestAdminReloadHosts(t *testing.T) {
+	s, ts := newTestAdminServer(t)
+	defer ts.Close()
+
+	if code := adminRequest(t, "POST", ts.URL+"/hosts/reload", "", nil); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if n := s.hostfile().(*reloadHostfile).reloads; n != 1 {
+		t.Fatalf("expected 1 reload, got %d", n)
+	}
+
+	s.hosts.Store(hostsHolder{testHostfile{}})
+	if code := adminRequest(t, "POST", ts.URL+"/hosts/reload", "", nil); code != http.StatusNotImplemented {
+		t.Fatalf("expected status 501, got %d", code)
+	}
+}
+
+func TestAdminUpstreams(t *testing.T) {
+	s, ts := newTestAdminServer(t)
+	defer ts.Close()
+
+	s.config().HealthCheckFailures = 1
+	s.updateHealth("192.0.2.1:53", fmt.Errorf("timeout"))
+
+	var result struct {
+		Upstreams []upstreamStatus
+	}
+	if code := adminRequest(t, "GET", ts.URL+"/upstreams", "", &result); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if len(result.Upstreams) != 2 {
+		t.Fatalf("expected 2 upstreams, got %+v", result.Upstreams)
+	}
+	for _, u := range result.Upstreams {
+		switch u.Address {
+		case "192.0.2.53:53":
+			if !u.Up || u.Since != nil || len(u.Zones) != 1 || u.Zones[0] != "." {
+				t.Errorf("unexpected state: %+v", u)
+			}
+		case "192.0.2.1:53":
+			if u.Up || u.Failures != 1 || u.Since == nil || len(u.Zones) != 1 || u.Zones[0] != "stub.example." {
+				t.Errorf("unexpected state: %+v", u)
+			}
+		default:
+			t.Errorf("unexpected upstream %s", u.Address)
+		}
+	}
+}
+
+func TestAdminStubs(t *testing.T) {
+	s, ts := newTestAdminServer(t)
+	defer ts.Close()
+
+	for _, name := range []string{"host.new.example.", "other.example."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Answer = []dns.RR{newA(name + " 60 IN A 192.0.2.1")}
+		s.rcache.InsertMessage(cache.Key(m.Question[0], false, false), m)
+	}
+
+	var stub adminStubZone
+	code := adminRequest(t, "PUT", ts.URL+"/stubs/New.Example",
+		`{"nameservers": ["192.0.2.2", "tls://192.0.2.3#dns.example"], "strategy": "parallel"}`, &stub)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	nservers := (*s.config().Stub)["new.example."]
+	if len(nservers) != 2 || nservers[0] != "192.0.2.2:53" || nservers[1] != "tls://192.0.2.3:853#dns.example" ||
+		s.config().StubStrategy["new.example."] != StrategyParallel {
+		t.Fatalf("unexpected stub zone: %v %v", nservers, s.config().StubStrategy)
+	}
+	if zone, ok := s.stubZone("host.new.example."); !ok || zone != "new.example." {
+		t.Fatalf("expected the new stub zone to be used, got %q", zone)
+	}
+	if s.rcache.Len() != 1 {
+		t.Fatalf("expected the cached responses for the stub zone to be removed, got %d responses", s.rcache.Len())
+	}
+
+	var stubs map[string]adminStubZone
+	if code := adminRequest(t, "GET", ts.URL+"/stubs", "", &stubs); code != http.StatusOK || len(stubs) != 2 {
+		t.Fatalf("expected 2 stub zones, got %d %v", code, stubs)
+	}
+
+	if code := adminRequest(t, "PUT", ts.URL+"/stubs/bad.example", `{"nameservers": ["bogus"]}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for an invalid nameserver, got %d", code)
+	}
+	if code := adminRequest(t, "PUT", ts.URL+"/stubs/bad.example", `{"nameservers": []}`, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 without nameservers, got %d", code)
+	}
+
+	if code := adminRequest(t, "DELETE", ts.URL+"/stubs/new.example.", "", nil); code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", code)
+	}
+	if _, ok := (*s.config().Stub)["new.example."]; ok {
+		t.Fatal("expected the stub zone to be removed")
+	}
+	if _, ok := s.config().StubStrategy["new.example."]; ok {
+		t.Fatal("expected the stub zone strategy to be removed")
+	}
+	if code := adminRequest(t, "DELETE", ts.URL+"/stubs/new.example.", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", code)
+	}
+	if code := adminRequest(t, "GET", ts.URL+"/stubs/stub.example", "", &stub); code != http.StatusOK ||
+		len(stub.Nameservers) != 1 {
+		t.Fatalf("expected the configured stub zone, got %d %v", code, stub)
+	}
+
+	s.config().Stub = nil
+	for _, path := range []string{"/stubs", "/upstreams"} {
+		if code := adminRequest(t, "GET", ts.URL+path, "", nil); code != http.StatusOK {
+			t.Fatalf("expected status 200 for %s without stub zones, got %d", path, code)
+		}
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	_, ts := newTestAdminServer(t)
+	defer ts.Close()
+
+	var config map[string]interface{}
+	if code := adminRequest(t, "GET", ts.URL+"/config", "", &config); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if config["rcache_ttl"] != 60.0 || config["fwd_timeout"] != "4s" {
+		t.Fatalf("unexpected config: %v", config)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	s, ts := newTestAdminServer(t)
+	defer ts.Close()
+
+	addr, shutdown := serveTestUpstream(t)
+	defer shutdown()
+	s.config().Nameservers = []string{addr}
+
+	// Without a token only loopback clients are served, except for the health
+	// check of the configured name
+	for path, expected := range map[string]int{
+		"/config":                    http.StatusForbidden,
+		"/healthz":                   http.StatusOK,
+		"/healthz?name=host.example": http.StatusForbidden,
+		"/healthz?type=A":            http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.0.2.9:1234"
+		w := httptest.NewRecorder()
+		s.adminMux().ServeHTTP(w, req)
+		if w.Code != expected {
+			t.Fatalf("expected status %d for %s from a remote client, got %d", expected, path, w.Code)
+		}
+	}
+
+	s.config().AdminToken = "secret"
+	for _, tc := range []struct {
+		path, auth string
+		expected   int
+	}{
+		{"/config", "", http.StatusUnauthorized},
+		{"/config", "Bearer bogus", http.StatusUnauthorized},
+		{"/config", "Bearer secret", http.StatusOK},
+		{"/healthz", "", http.StatusOK},
+		{"/healthz?name=host.example", "", http.StatusUnauthorized},
+		{"/healthz?name=host.example", "Bearer secret", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+tc.path, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&config)
+		resp.Body.Close()
+		if resp.StatusCode != tc.expected {
+			t.Fatalf("expected status %d for %s with '%s', got %d", tc.expected, tc.path, tc.auth, resp.StatusCode)
+		}
+		if _, ok := config["admin_token"]; ok {
+			t.Fatal("expected the admin token to be left out of the config")
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/codegangsta/cli"
 	"github.com/miekg/dns"
 )
 
@@ -19,6 +18,22 @@ import (
 type Config struct {
 	// The ip:port go-dnsmasq should be listening on for incoming DNS requests.
 	DnsAddr string `json:"dns_addr,omitempty"`
+	// The ip:port go-dnsmasq should be listening on for DNS-over-TLS requests.
+	TLSAddr string `json:"tls_addr,omitempty"`
+	// The ip:port go-dnsmasq should be listening on for DNS-over-HTTPS requests.
+	DoHAddr string `json:"doh_addr,omitempty"`
+	// The ip:port for unencrypted DNS-over-HTTP requests, e.g. behind a TLS terminating proxy.
+	DoHHTTPAddr string `json:"doh_http_addr,omitempty"`
+	// Address of the admin HTTP API, empty disables it.
+	AdminAddr string `json:"admin_addr,omitempty"`
+	// Bearer token required by the admin API, without it only loopback
+	// clients are served.
+	AdminToken string `json:"admin_token,omitempty"`
+	// Address to serve Prometheus metrics on, empty disables it.
+	PrometheusAddr string `json:"prometheus_addr,omitempty"`
+	// PEM encoded certificate and private key used by the TLS listeners.
+	TLSCertFile string `json:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `json:"tls_key_file,omitempty"`
 	// bind to port(s) activated by systemd. If set to true, this overrides DnsAddr.
 	Systemd bool `json:"systemd,omitempty"`
 	// Rewrite host's network config making go-dnsmasq the default resolver
@@ -31,33 +46,105 @@ type Config struct {
 	Hostsfile string `json:"hostfile,omitempty"`
 	// Hostfile Polling
 	PollInterval int `json:"poll_interval,omitempty"`
+	// Paths to additional hostfiles
+	AddnHosts []string `json:"addn_hosts,omitempty"`
+	// Static addresses answered for a domain and its subdomains. Map contains
+	// domainname -> IPs, an empty list answers NXDOMAIN.
+	Addresses map[string][]string `json:"addresses,omitempty"`
+	// Domains answered from the hostfiles only, queries are never forwarded.
+	LocalDomains []string `json:"local_domains,omitempty"`
 	// Round robin A/AAAA replies. Default is true.
 	RoundRobin bool `json:"round_robin,omitempty"`
 	// List of ip:port, seperated by commas of recursive nameservers to forward queries to.
+	// DNS-over-TLS nameservers are given as tls://ip:port#servername,
+	// DNS-over-HTTPS nameservers as https://host[:port]/path.
 	Nameservers []string `json:"nameservers,omitempty"`
+	// Don't read nameservers and search domains from /etc/resolv.conf.
+	NoResolv bool `json:"no_resolv,omitempty"`
+	// Answer reverse lookups for private address ranges with NXDOMAIN if not
+	// found in the hostfiles instead of forwarding them.
+	BogusPriv bool `json:"bogus_priv,omitempty"`
+	// PEM encoded CA bundle used to verify encrypted nameservers instead of the system roots.
+	UpstreamCAFile string `json:"upstream_ca_file,omitempty"`
+	// How to select the nameserver to query: sequential, round-robin, random, fastest or parallel.
+	UpstreamStrategy string `json:"upstream_strategy,omitempty"`
+	// How often to probe upstream nameservers in seconds, 0 disables health checking.
+	HealthCheckInterval int `json:"health_check_interval,omitempty"`
+	// Name queried (type NS) to probe upstream nameservers. Defaults to ".".
+	HealthCheckName string `json:"health_check_name,omitempty"`
+	// Number of consecutive failed probes before a nameserver is marked down. Defaults to 3.
+	HealthCheckFailures int `json:"health_check_failures,omitempty"`
 	// Never provide a recursive service.
 	NoRec       bool          `json:"no_rec,omitempty"`
 	ReadTimeout time.Duration `json:"read_timeout,omitempty"`
+	// EDNS0 UDP buffer size advertised to clients and nameservers. Defaults to 1232.
+	EdnsBufSize uint16 `json:"edns_bufsize,omitempty"`
+	// Don't retry queries over TCP when a nameserver returns a truncated UDP response.
+	NoTCPFallback bool `json:"no_tcp_fallback,omitempty"`
+	// How many times a query is sent to the nameservers before giving up. Defaults to 2.
+	FwdAttempts int `json:"fwd_attempts,omitempty"`
+	// Timeout of a single query sent to a nameserver. Defaults to twice ReadTimeout or 4s.
+	FwdTimeout time.Duration `json:"fwd_timeout,omitempty"`
+	// Time budget for resolving a client query, including all search domains. 0 disables the limit.
+	FwdDeadline time.Duration `json:"fwd_deadline,omitempty"`
+	// How long to wait for queries in flight to be answered when stopping. Defaults to 5s.
+	ShutdownTimeout time.Duration `json:"shutdown_timeout,omitempty"`
 	// Default TTL, in seconds. Defaults to 360.
 	Ttl uint32 `json:"ttl,omitempty"`
 	// Default TTL for Hostfile records, in seconds. Defaults to 30.
 	HostsTtl uint32 `json:"hostfile_ttl,omitempty"`
 	// RCache, capacity of response cache in resource records stored.
 	RCache int `json:"rcache,omitempty"`
-	// RCacheTtl, how long to cache in seconds.
+	// RCacheMaxSize, upper bound of the memory used by the response cache in MB, 0 for no limit.
+	RCacheMaxSize int `json:"rcache_max_size,omitempty"`
+	// RCacheTtl, how long to cache negative responses without SOA record in seconds.
 	RCacheTtl int `json:"rcache_ttl,omitempty"`
+	// Lowest and highest TTL in seconds of cached records. Responses are cached
+	// until their lowest record TTL expires. Defaults to 0 and 86400.
+	MinCacheTtl int `json:"min_cache_ttl,omitempty"`
+	MaxCacheTtl int `json:"max_cache_ttl,omitempty"`
+	// Highest TTL in seconds of cached NXDOMAIN and NODATA responses. Defaults to 3600.
+	MaxNegCacheTtl int `json:"max_neg_cache_ttl,omitempty"`
+	// How long to cache SERVFAIL responses in seconds, 0 disables caching them.
+	ServfailCacheTtl int `json:"servfail_cache_ttl,omitempty"`
+	// How long in seconds expired responses are kept to answer queries the
+	// nameservers fail to resolve, 0 disables serving stale responses (RFC 8767).
+	StaleCacheTtl int `json:"stale_cache_ttl,omitempty"`
+	// How long to wait for the nameservers before answering with a stale
+	// response, 0 to only answer with it when resolving fails.
+	StaleAnswerTimeout time.Duration `json:"stale_answer_timeout,omitempty"`
 	// How many dots a name must have before we allow to forward the query as-is. Defaults to 1.
 	FwdNdots int `json:"fwd_ndots,omitempty"`
 	// How many dots a name must have before we do an initial absolute query. Defaults to 1.
 	Ndots int `json:"ndots,omitempty"`
 
-	Verbose bool `json:"-"`
+	Verbose bool `json:"verbose,omitempty"`
+
+	// Where to log client queries: a file path, "stdout" or "syslog". Empty disables the query log.
+	QueryLog string `json:"query_log,omitempty"`
+	// Format of the query log records: json or logfmt. Defaults to json.
+	QueryLogFormat string `json:"query_log_format,omitempty"`
+	// Size in megabytes at which the query log file is rotated, 0 disables rotation.
+	QueryLogMaxSize int `json:"query_log_max_size,omitempty"`
+	// Number of rotated query log files to keep, 0 truncates the file instead.
+	QueryLogBackups int `json:"query_log_backups,omitempty"`
+	// Where to send dnstap messages: "unix:/path" for a Frame Streams socket,
+	// otherwise a file path. Empty disables dnstap.
+	Dnstap string `json:"dnstap,omitempty"`
 
 	// Stub zones support. Map contains domainname -> nameserver:port
-	Stub *map[string][]string
+	Stub *map[string][]string `json:"stub_zones,omitempty"`
+	// Upstream selection strategy for stub zones. Map contains domainname -> strategy
+	StubStrategy map[string]string `json:"stub_strategy,omitempty"`
 }
 
-func ResolvConf(config *Config, ctx *cli.Context) error {
+// ResolvConf sets the nameservers, search domains and ndots from /etc/resolv.conf
+// unless they are configured. keepNdots is true if ndots was configured.
+func ResolvConf(config *Config, keepNdots bool) error {
+	if config.NoResolv {
+		return nil
+	}
+
 	// Get host resolv config
 	resolvConf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
 	if err != nil {
@@ -70,7 +157,7 @@ func ResolvConf(config *Config, ctx *cli.Context) error {
 		}
 	}
 
-	if !ctx.IsSet("ndots") && resolvConf.Ndots != 1 {
+	if !keepNdots && resolvConf.Ndots != 1 {
 		log.Debugf("Setting ndots from resolv.conf: %d", resolvConf.Ndots)
 		config.Ndots = resolvConf.Ndots
 	}
@@ -89,6 +176,12 @@ func CheckConfig(config *Config) error {
 	if config.DnsAddr == "" {
 		return fmt.Errorf("'listen' cannot be empty")
 	}
+	if config.TLSAddr != "" && (config.TLSCertFile == "" || config.TLSKeyFile == "") {
+		return fmt.Errorf("'tls-listen' requires both 'tls-cert' and 'tls-key'")
+	}
+	if config.DoHAddr != "" && (config.TLSCertFile == "" || config.TLSKeyFile == "") {
+		return fmt.Errorf("'doh-listen' requires both 'tls-cert' and 'tls-key'")
+	}
 	if !config.NoRec && len(config.Nameservers) == 0 {
 		return fmt.Errorf("Recursion is enabled but no nameservers are configured")
 	}
@@ -96,12 +189,105 @@ func CheckConfig(config *Config) error {
 		config.EnableSearch = false
 		log.Warnf("No search domains configured, disabling search.")
 	}
+	if config.UpstreamCAFile != "" {
+		if _, err := loadCertPool(config.UpstreamCAFile); err != nil {
+			return fmt.Errorf("Failed to load 'upstream-ca': %s", err)
+		}
+	}
+	if config.UpstreamStrategy == "" {
+		config.UpstreamStrategy = StrategySequential
+	}
+	if !ValidStrategy(config.UpstreamStrategy) {
+		return fmt.Errorf("Unknown 'upstream-strategy': %s", config.UpstreamStrategy)
+	}
+	if config.EdnsBufSize == 0 {
+		config.EdnsBufSize = defaultEdnsBufSize
+	}
+	if config.EdnsBufSize < 512 {
+		return fmt.Errorf("'edns-bufsize' must be at least 512")
+	}
+	if config.FwdAttempts == 0 {
+		config.FwdAttempts = 2
+	}
+	if config.FwdAttempts < 0 {
+		return fmt.Errorf("'fwd-attempts' must be greater than 0")
+	}
+	if config.FwdTimeout == 0 {
+		config.FwdTimeout = 2 * config.ReadTimeout
+		if config.FwdTimeout == 0 {
+			config.FwdTimeout = 4 * time.Second
+		}
+	}
+	if config.FwdTimeout <= 0 {
+		return fmt.Errorf("'fwd-timeout' must be greater than 0")
+	}
+	if config.FwdDeadline < 0 {
+		return fmt.Errorf("'fwd-deadline' must be equal or greater than 0")
+	}
+	if config.ShutdownTimeout == 0 {
+		config.ShutdownTimeout = 5 * time.Second
+	}
+	if config.ShutdownTimeout < 0 {
+		return fmt.Errorf("'shutdown-timeout' must be greater than 0")
+	}
+	if config.HealthCheckInterval < 0 {
+		return fmt.Errorf("'health-interval' must be equal or greater than 0")
+	}
+	if config.HealthCheckFailures <= 0 {
+		config.HealthCheckFailures = 3
+	}
+	if config.HealthCheckName == "" {
+		config.HealthCheckName = "."
+	}
+	config.HealthCheckName = dns.Fqdn(config.HealthCheckName)
+	if _, ok := dns.IsDomainName(config.HealthCheckName); !ok {
+		return fmt.Errorf("'health-name' is not a valid domain name: %s", config.HealthCheckName)
+	}
+	if config.QueryLogFormat == "" {
+		config.QueryLogFormat = QueryLogJSON
+	}
+	if config.QueryLogFormat != QueryLogJSON && config.QueryLogFormat != QueryLogLogfmt {
+		return fmt.Errorf("Unknown 'query-log-format': %s", config.QueryLogFormat)
+	}
+	if config.QueryLogMaxSize < 0 {
+		return fmt.Errorf("'query-log-max-size' must be equal or greater than 0")
+	}
+	if config.QueryLogBackups < 0 {
+		return fmt.Errorf("'query-log-backups' must be equal or greater than 0")
+	}
 	if config.RCache < 0 {
 		return fmt.Errorf("'rcache' must be equal or greater than 0")
 	}
+	if config.RCacheMaxSize < 0 {
+		return fmt.Errorf("'rcache-max-size' must be equal or greater than 0")
+	}
 	if config.RCacheTtl <= 0 {
 		return fmt.Errorf("'rcache-ttl' must be greater than 0")
 	}
+	if config.MaxCacheTtl == 0 {
+		config.MaxCacheTtl = 86400
+	}
+	if config.MinCacheTtl < 0 {
+		return fmt.Errorf("'min-cache-ttl' must be equal or greater than 0")
+	}
+	if config.MaxCacheTtl < config.MinCacheTtl {
+		return fmt.Errorf("'max-cache-ttl' must be equal or greater than 'min-cache-ttl'")
+	}
+	if config.MaxNegCacheTtl == 0 {
+		config.MaxNegCacheTtl = 3600
+	}
+	if config.MaxNegCacheTtl < 0 {
+		return fmt.Errorf("'max-neg-cache-ttl' must be greater than 0")
+	}
+	if config.ServfailCacheTtl < 0 {
+		return fmt.Errorf("'servfail-cache-ttl' must be equal or greater than 0")
+	}
+	if config.StaleCacheTtl < 0 {
+		return fmt.Errorf("'stale-cache-ttl' must be equal or greater than 0")
+	}
+	if config.StaleAnswerTimeout < 0 {
+		return fmt.Errorf("'stale-answer-timeout' must be equal or greater than 0")
+	}
 	if config.Ndots <= 0 {
 		return fmt.Errorf("'ndots' must be greater than 0")
 	}
@@ -110,11 +296,32 @@ func CheckConfig(config *Config) error {
 	}
 
 	// Set defaults
-	config.Ttl = 360
-	config.HostsTtl = 10
+	if config.Ttl == 0 {
+		config.Ttl = 360
+	}
+	if config.HostsTtl == 0 {
+		config.HostsTtl = 10
+	}
 
-	stubmap := make(map[string][]string)
-	config.Stub = &stubmap
+	if config.Stub == nil {
+		stubmap := make(map[string][]string)
+		config.Stub = &stubmap
+	}
+	for domain, ips := range config.Addresses {
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("Invalid address for %s: %s", domain, ip)
+			}
+		}
+	}
+	for zone, strategy := range config.StubStrategy {
+		if _, ok := (*config.Stub)[zone]; !ok {
+			return fmt.Errorf("No stubzone configured for stubzone strategy domain: %s", zone)
+		}
+		if !ValidStrategy(strategy) {
+			return fmt.Errorf("Unknown stubzone strategy for %s: %s", zone, strategy)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,119 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ReadConfigFile reads a JSON or YAML config file into config and returns
+// the names of the Config fields given in the file, including those set to
+// their zero value. The keys are the json tags of Config, durations may be
+// given as strings like "1500ms". Unknown keys are an error.
+func ReadConfigFile(path string, config *Config) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is valid YAML, so both are handled the same way
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	for name := range durationFields() {
+		s, ok := values[name].(string)
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration for '%s': %s", name, s)
+		}
+		values[name] = int64(d)
+	}
+	if data, err = json.Marshal(values); err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	for name, field := range jsonFields() {
+		if _, ok := values[name]; ok {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// FormatConfig returns the config as indented JSON, in the format read by
+// ReadConfigFile.
+func FormatConfig(config *Config) ([]byte, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(config).Elem()
+	for name, field := range durationFields() {
+		if _, ok := values[name]; ok {
+			values[name] = v.FieldByName(field).Interface().(time.Duration).String()
+		}
+	}
+	return json.MarshalIndent(values, "", "  ")
+}
+
+// durationFields returns the json keys of the duration fields of Config
+// mapped to the field names.
+func durationFields() map[string]string {
+	return configFields(durationType)
+}
+
+// jsonFields returns the json keys of all fields of Config mapped to the
+// field names.
+func jsonFields() map[string]string {
+	return configFields(nil)
+}
+
+// configFields returns the json keys of the fields of Config of type t, or
+// of all fields if t is nil, mapped to the field names.
+func configFields(t reflect.Type) map[string]string {
+	fields := make(map[string]string)
+	ct := reflect.TypeOf(Config{})
+	for i := 0; i < ct.NumField(); i++ {
+		f := ct.Field(i)
+		if t != nil && f.Type != t {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = f.Name
+	}
+	return fields
+}
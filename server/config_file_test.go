@@ -0,0 +1,96 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func writeTempFile(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := writeTempFile(t, "config.yaml", `
+dns_addr: 127.0.0.1:53
+nameservers:
+  - 8.8.8.8:53
+fwd_timeout: 1500ms
+read_timeout: 1000000000
+rcache: 100
+verbose: false
+stub_zones:
+  corp.local.: [10.0.0.1:53]
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config := new(Config)
+	fields, err := ReadConfigFile(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fields set to their zero value are reported too
+	sort.Strings(fields)
+	expectedFields := []string{"DnsAddr", "FwdTimeout", "Nameservers", "RCache", "ReadTimeout", "Stub", "Verbose"}
+	if !reflect.DeepEqual(fields, expectedFields) {
+		t.Fatalf("expected fields %v, got %v", expectedFields, fields)
+	}
+	expected := &Config{
+		DnsAddr:     "127.0.0.1:53",
+		Nameservers: []string{"8.8.8.8:53"},
+		FwdTimeout:  1500 * time.Millisecond,
+		ReadTimeout: time.Second,
+		RCache:      100,
+		Stub:        &map[string][]string{"corp.local.": {"10.0.0.1:53"}},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, config)
+	}
+
+	// The formatted config can be read back
+	out, err := FormatConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonPath := writeTempFile(t, "config.json", string(out))
+	defer os.RemoveAll(filepath.Dir(jsonPath))
+	config = new(Config)
+	if _, err := ReadConfigFile(jsonPath, config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, config)
+	}
+}
+
+func TestReadConfigFileInvalid(t *testing.T) {
+	testcases := []string{
+		"dns_adr: 127.0.0.1:53",
+		"fwd_timeout: soon",
+		"rcache: many",
+		"{",
+	}
+	for _, tc := range testcases {
+		path := writeTempFile(t, "config.yaml", tc)
+		if _, err := ReadConfigFile(path, new(Config)); err == nil {
+			t.Errorf("expected error for %q", tc)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ReadDnsmasqConf reads the directives of a dnsmasq.conf file into config.
+// Directives that go-dnsmasq doesn't support are logged and ignored.
+func ReadDnsmasqConf(path string, config *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.Index(line, "="); i >= 0 {
+			key, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		err := applyDnsmasqDirective(config, key, value)
+		if e, ok := err.(unsupportedError); ok {
+			log.Warnf("Ignoring unsupported directive '%s' in %s:%d: %s", key, path, lineno, e)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// unsupportedError is returned for valid dnsmasq directives or values that
+// go-dnsmasq doesn't support.
+type unsupportedError string
+
+func (e unsupportedError) Error() string { return string(e) }
+
+func applyDnsmasqDirective(config *Config, key, value string) error {
+	switch key {
+	case "server", "local":
+		domains, addr, ok := splitDomains(value)
+		if strings.Contains(addr, "@") {
+			return unsupportedError("source address or interface is not supported")
+		}
+		if !ok {
+			if addr == "" {
+				return fmt.Errorf("missing nameserver address")
+			}
+			ns, err := dnsmasqNameserver(addr)
+			if err != nil {
+				return err
+			}
+			config.Nameservers = append(config.Nameservers, ns)
+			return nil
+		}
+		if addr == "" {
+			// Answer from the hostfiles only
+			config.LocalDomains = append(config.LocalDomains, domains...)
+			return nil
+		}
+		if addr == "#" {
+			return unsupportedError("using the default nameservers for a domain is not supported")
+		}
+		for _, domain := range domains {
+			if domain == "#" {
+				return unsupportedError("matching all domains is not supported")
+			}
+		}
+		ns, err := dnsmasqNameserver(addr)
+		if err != nil {
+			return err
+		}
+		if config.Stub == nil {
+			config.Stub = &map[string][]string{}
+		}
+		for _, domain := range domains {
+			(*config.Stub)[domain] = append((*config.Stub)[domain], ns)
+		}
+	case "address":
+		domains, addr, ok := splitDomains(value)
+		if !ok {
+			return fmt.Errorf("expected /domain/address")
+		}
+		if config.Addresses == nil && addr != "" {
+			config.Addresses = make(map[string][]string)
+		}
+		for _, domain := range domains {
+			if domain == "#" {
+				return unsupportedError("matching all domains is not supported")
+			}
+			switch addr {
+			case "":
+				// Answer from the hostfiles only
+				config.LocalDomains = append(config.LocalDomains, domain)
+			case "#":
+				config.Addresses[domain] = append(config.Addresses[domain], "0.0.0.0", "::")
+			default:
+				if net.ParseIP(addr) == nil {
+					return fmt.Errorf("invalid address: %s", addr)
+				}
+				config.Addresses[domain] = append(config.Addresses[domain], addr)
+			}
+		}
+	case "addn-hosts":
+		if value == "" {
+			return fmt.Errorf("missing path")
+		}
+		config.AddnHosts = append(config.AddnHosts, value)
+	case "cache-size":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid cache size: %s", value)
+		}
+		config.RCache = n
+	case "min-cache-ttl", "max-cache-ttl", "neg-ttl":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid TTL: %s", value)
+		}
+		switch key {
+		case "min-cache-ttl":
+			config.MinCacheTtl = n
+		case "max-cache-ttl":
+			config.MaxCacheTtl = n
+		case "neg-ttl":
+			config.RCacheTtl = n
+		}
+	case "domain-needed":
+		config.FwdNdots = 1
+	case "bogus-priv":
+		config.BogusPriv = true
+	case "no-resolv":
+		config.NoResolv = true
+	case "listen-address":
+		addrs := strings.Split(value, ",")
+		if len(addrs) > 1 || config.DnsAddr != "" {
+			return unsupportedError("listening on more than one address is not supported")
+		}
+		ip := net.ParseIP(strings.TrimSpace(addrs[0]))
+		if ip == nil {
+			return fmt.Errorf("invalid listen address: %s", value)
+		}
+		config.DnsAddr = net.JoinHostPort(ip.String(), "53")
+	default:
+		return unsupportedError("not implemented")
+	}
+	return nil
+}
+
+// splitDomains splits a value of the form /domain1/domain2/rest. ok is false
+// if the value doesn't start with a domain list.
+func splitDomains(value string) (domains []string, rest string, ok bool) {
+	i := strings.LastIndex(value, "/")
+	if !strings.HasPrefix(value, "/") || i == 0 {
+		return nil, value, false
+	}
+	for _, domain := range strings.Split(value[1:i], "/") {
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, value[i+1:], len(domains) > 0
+}
+
+// dnsmasqNameserver converts a dnsmasq nameserver address ip[#port] to ip:port.
+func dnsmasqNameserver(addr string) (string, error) {
+	host, port := addr, "53"
+	if i := strings.Index(addr, "#"); i >= 0 {
+		host, port = addr[:i], addr[i+1:]
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid nameserver address: %s", addr)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid nameserver port: %s", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
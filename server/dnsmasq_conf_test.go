@@ -0,0 +1,87 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadDnsmasqConf(t *testing.T) {
+	path := writeTempFile(t, "dnsmasq.conf", `
+# upstream nameservers
+server=8.8.8.8
+server=2001:4860:4860::8888#5353
+server=/corp.local/10.0.0.1
+server=/a.local/b.local/10.0.0.2#54
+local=/lan/
+address=/ads.example/0.0.0.0
+address=/blocked.example/#
+address=/nowhere.example/
+addn-hosts=/etc/hosts.extra
+cache-size=500
+min-cache-ttl=30
+max-cache-ttl=3600
+neg-ttl=20
+domain-needed
+bogus-priv
+no-resolv
+listen-address=127.0.0.2
+dhcp-range=192.168.0.50,192.168.0.150,12h
+server=10.0.0.3@eth0
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config := new(Config)
+	if err := ReadDnsmasqConf(path, config); err != nil {
+		t.Fatal(err)
+	}
+	expected := &Config{
+		DnsAddr:     "127.0.0.2:53",
+		Nameservers: []string{"8.8.8.8:53", "[2001:4860:4860::8888]:5353"},
+		Stub: &map[string][]string{
+			"corp.local": {"10.0.0.1:53"},
+			"a.local":    {"10.0.0.2:54"},
+			"b.local":    {"10.0.0.2:54"},
+		},
+		LocalDomains: []string{"lan", "nowhere.example"},
+		Addresses: map[string][]string{
+			"ads.example":     {"0.0.0.0"},
+			"blocked.example": {"0.0.0.0", "::"},
+		},
+		AddnHosts:   []string{"/etc/hosts.extra"},
+		RCache:      500,
+		RCacheTtl:   20,
+		MinCacheTtl: 30,
+		MaxCacheTtl: 3600,
+		FwdNdots:    1,
+		BogusPriv:   true,
+		NoResolv:    true,
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, config)
+	}
+}
+
+func TestReadDnsmasqConfInvalid(t *testing.T) {
+	testcases := []string{
+		"server=not-an-ip",
+		"server=8.8.8.8#port",
+		"address=/example/not-an-ip",
+		"address=1.2.3.4",
+		"cache-size=-1",
+		"min-cache-ttl=soon",
+		"listen-address=localhost",
+	}
+	for _, tc := range testcases {
+		path := writeTempFile(t, "dnsmasq.conf", tc)
+		if err := ReadDnsmasqConf(path, new(Config)); err == nil {
+			t.Errorf("expected error for %q", tc)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+const dnstapSocketScheme = "unix:"
+
+// dnstapOutput sends dnstap messages in Frame Streams format to a Unix
+// socket or a file. Messages are dropped if the output can't keep up.
+type dnstapOutput struct {
+	mu       sync.RWMutex
+	out      dnstap.Output
+	closed   bool
+	identity []byte
+	version  []byte
+}
+
+// openDnstap opens the dnstap output configured in config. It returns nil if
+// dnstap is disabled.
+func openDnstap(config *Config, version string) (*dnstapOutput, error) {
+	if config.Dnstap == "" {
+		return nil, nil
+	}
+	var out dnstap.Output
+	if strings.HasPrefix(config.Dnstap, dnstapSocketScheme) {
+		path := strings.TrimPrefix(strings.TrimPrefix(config.Dnstap, dnstapSocketScheme), "//")
+		o, err := dnstap.NewFrameStreamSockOutput(&net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		o.SetLogger(log.StandardLogger())
+		out = o
+	} else {
+		o, err := dnstap.NewFrameStreamOutputFromFilename(config.Dnstap)
+		if err != nil {
+			return nil, err
+		}
+		o.SetLogger(log.StandardLogger())
+		out = o
+	}
+	go out.RunOutputLoop()
+
+	hostname, _ := os.Hostname()
+	return &dnstapOutput{out: out, identity: []byte(hostname), version: []byte("go-dnsmasq " + version)}, nil
+}
+
+// Close flushes pending messages and closes the output.
+func (d *dnstapOutput) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.closed {
+		d.closed = true
+		d.out.Close()
+	}
+}
+
+func (d *dnstapOutput) send(m *dnstap.Message) {
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Identity: d.identity,
+		Version:  d.version,
+		Message:  m,
+	})
+	if err != nil {
+		log.Errorf("Failed to encode dnstap message: %s", err)
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.out.GetOutputChannel() <- frame:
+	default:
+		log.Debugf("Dropping dnstap message, output is busy")
+	}
+}
+
+// clientQuery sends a CLIENT_QUERY message for a query received on w.
+func (d *dnstapOutput) clientQuery(w dns.ResponseWriter, req *dns.Msg, proto string, queryTime time.Time) {
+	if d == nil {
+		return
+	}
+	m := clientMessage(dnstap.Message_CLIENT_QUERY, w, proto)
+	setQuery(m, req, queryTime)
+	d.send(m)
+}
+
+// clientResponse sends a CLIENT_RESPONSE message for the response written to w.
+func (d *dnstapOutput) clientResponse(w dns.ResponseWriter, req, resp *dns.Msg, proto string, queryTime time.Time) {
+	if d == nil {
+		return
+	}
+	m := clientMessage(dnstap.Message_CLIENT_RESPONSE, w, proto)
+	setQuery(m, req, queryTime)
+	setResponse(m, resp, time.Now())
+	d.send(m)
+}
+
+// forwarderQuery sends a FORWARDER_QUERY message for a query sent to the
+// nameserver addr.
+func (d *dnstapOutput) forwarderQuery(addr string, req *dns.Msg, tcp bool, queryTime time.Time) {
+	if d == nil {
+		return
+	}
+	m := forwarderMessage(dnstap.Message_FORWARDER_QUERY, addr, tcp)
+	setQuery(m, req, queryTime)
+	d.send(m)
+}
+
+// forwarderResponse sends a FORWARDER_RESPONSE message for a response of the
+// nameserver addr.
+func (d *dnstapOutput) forwarderResponse(addr string, req, resp *dns.Msg, tcp bool, queryTime time.Time) {
+	if d == nil {
+		return
+	}
+	m := forwarderMessage(dnstap.Message_FORWARDER_RESPONSE, addr, tcp)
+	setQuery(m, req, queryTime)
+	setResponse(m, resp, time.Now())
+	d.send(m)
+}
+
+func clientMessage(t dnstap.Message_Type, w dns.ResponseWriter, proto string) *dnstap.Message {
+	m := &dnstap.Message{Type: t.Enum()}
+	switch proto {
+	case "udp":
+		m.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+	case "tcp":
+		m.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+	case "tls":
+		m.SocketProtocol = dnstap.SocketProtocol_DOT.Enum()
+	case "https", "http":
+		m.SocketProtocol = dnstap.SocketProtocol_DOH.Enum()
+	}
+	if ip, port, ok := splitAddr(w.RemoteAddr()); ok {
+		m.SocketFamily = socketFamily(ip)
+		m.QueryAddress, m.QueryPort = ip, &port
+	}
+	if ip, port, ok := splitAddr(w.LocalAddr()); ok {
+		m.ResponseAddress, m.ResponsePort = ip, &port
+	}
+	return m
+}
+
+func forwarderMessage(t dnstap.Message_Type, addr string, tcp bool) *dnstap.Message {
+	m := &dnstap.Message{Type: t.Enum()}
+	var hostPort string
+	switch {
+	case strings.HasPrefix(addr, tlsScheme):
+		m.SocketProtocol = dnstap.SocketProtocol_DOT.Enum()
+		hostPort, _ = splitServerName(strings.TrimPrefix(addr, tlsScheme))
+	case strings.HasPrefix(addr, httpsScheme):
+		m.SocketProtocol = dnstap.SocketProtocol_DOH.Enum()
+		if u, err := url.Parse(addr); err == nil {
+			hostPort = u.Host
+			if u.Port() == "" {
+				hostPort = net.JoinHostPort(u.Hostname(), "443")
+			}
+		}
+	case tcp:
+		m.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+		hostPort = addr
+	default:
+		m.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+		hostPort = addr
+	}
+	host, p, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return m
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if ip := net.ParseIP(host); ip != nil && err == nil {
+		ip, port := normalizeIP(ip), uint32(port)
+		m.SocketFamily = socketFamily(ip)
+		m.ResponseAddress, m.ResponsePort = ip, &port
+	}
+	return m
+}
+
+func setQuery(m *dnstap.Message, req *dns.Msg, t time.Time) {
+	if b, err := req.Pack(); err == nil {
+		m.QueryMessage = b
+	}
+	sec, nsec := uint64(t.Unix()), uint32(t.Nanosecond())
+	m.QueryTimeSec, m.QueryTimeNsec = &sec, &nsec
+}
+
+func setResponse(m *dnstap.Message, resp *dns.Msg, t time.Time) {
+	if b, err := resp.Pack(); err == nil {
+		m.ResponseMessage = b
+	}
+	sec, nsec := uint64(t.Unix()), uint32(t.Nanosecond())
+	m.ResponseTimeSec, m.ResponseTimeNsec = &sec, &nsec
+}
+
+// splitAddr returns the IP and port of a UDP or TCP address.
+func splitAddr(addr net.Addr) (net.IP, uint32, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return normalizeIP(a.IP), uint32(a.Port), true
+	case *net.TCPAddr:
+		return normalizeIP(a.IP), uint32(a.Port), true
+	}
+	return nil, 0, false
+}
+
+// normalizeIP returns IPv4 addresses in their 4 byte form.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func socketFamily(ip net.IP) *dnstap.SocketFamily {
+	if len(ip) == net.IPv4len {
+		return dnstap.SocketFamily_INET.Enum()
+	}
+	return dnstap.SocketFamily_INET6.Enum()
+}
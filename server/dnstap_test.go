@@ -0,0 +1,154 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+func TestDnstap(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen on udp: %v", err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{newA("host.example.com. 3600 IN A 192.0.2.1")}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnstap.fstrm")
+
+	config := &Config{
+		DnsAddr:     "127.0.0.1:0",
+		RCacheTtl:   60,
+		Ndots:       1,
+		Nameservers: []string{pc.LocalAddr().String()},
+		Dnstap:      path,
+	}
+	CheckConfig(config)
+	s := New(testHostfile{}, config, "test")
+	if s.dnstap, err = openDnstap(config, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.example.com.", dns.TypeA)
+	s.ServeDNS(new(testWriter), req)
+	s.dnstap.Close()
+	// Messages sent after closing are dropped
+	s.ServeDNS(new(testWriter), req)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := dnstap.NewReader(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := dnstap.NewDecoder(r, 65536)
+
+	expected := []dnstap.Message_Type{
+		dnstap.Message_CLIENT_QUERY,
+		dnstap.Message_FORWARDER_QUERY,
+		dnstap.Message_FORWARDER_RESPONSE,
+		dnstap.Message_CLIENT_RESPONSE,
+	}
+	var types []dnstap.Message_Type
+	for {
+		var frame dnstap.Dnstap
+		if err := dec.Decode(&frame); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		m := frame.Message
+		types = append(types, m.GetType())
+		if string(frame.Version) != "go-dnsmasq test" {
+			t.Errorf("unexpected version %q", frame.Version)
+		}
+
+		switch m.GetType() {
+		case dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE:
+			if !net.IP(m.QueryAddress).Equal(net.IPv4(127, 0, 0, 1)) || m.GetQueryPort() != 40000 ||
+				m.GetSocketProtocol() != dnstap.SocketProtocol_UDP || m.GetSocketFamily() != dnstap.SocketFamily_INET {
+				t.Errorf("unexpected client endpoint in %v", m)
+			}
+		case dnstap.Message_FORWARDER_QUERY, dnstap.Message_FORWARDER_RESPONSE:
+			addr := pc.LocalAddr().(*net.UDPAddr)
+			if !net.IP(m.ResponseAddress).Equal(addr.IP) || m.GetResponsePort() != uint32(addr.Port) {
+				t.Errorf("unexpected upstream endpoint in %v", m)
+			}
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(m.QueryMessage); err != nil || q.Question[0].Name != "host.example.com." {
+			t.Errorf("unexpected query message in %v: %v", m.GetType(), err)
+		}
+		if m.GetType() == dnstap.Message_CLIENT_RESPONSE || m.GetType() == dnstap.Message_FORWARDER_RESPONSE {
+			resp := new(dns.Msg)
+			if err := resp.Unpack(m.ResponseMessage); err != nil || len(resp.Answer) != 1 {
+				t.Errorf("unexpected response message in %v: %v", m.GetType(), err)
+			}
+		}
+	}
+	if len(types) != len(expected) {
+		t.Fatalf("expected messages %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("expected messages %v, got %v", expected, types)
+		}
+	}
+}
+
+func TestForwarderEndpoint(t *testing.T) {
+	tests := []struct {
+		addr  string
+		tcp   bool
+		proto dnstap.SocketProtocol
+		ip    string
+		port  uint32
+	}{
+		{"192.0.2.1:53", false, dnstap.SocketProtocol_UDP, "192.0.2.1", 53},
+		{"[2001:db8::1]:53", true, dnstap.SocketProtocol_TCP, "2001:db8::1", 53},
+		{"tls://192.0.2.1:853#dns.example.com", false, dnstap.SocketProtocol_DOT, "192.0.2.1", 853},
+		{"https://192.0.2.1/dns-query", false, dnstap.SocketProtocol_DOH, "192.0.2.1", 443},
+		{"https://dns.example.com/dns-query", false, dnstap.SocketProtocol_DOH, "", 0},
+	}
+	for _, tc := range tests {
+		m := forwarderMessage(dnstap.Message_FORWARDER_QUERY, tc.addr, tc.tcp)
+		if m.GetSocketProtocol() != tc.proto {
+			t.Errorf("%s: expected protocol %v, got %v", tc.addr, tc.proto, m.GetSocketProtocol())
+		}
+		if tc.ip == "" {
+			if m.ResponseAddress != nil {
+				t.Errorf("%s: expected no address, got %v", tc.addr, net.IP(m.ResponseAddress))
+			}
+			continue
+		}
+		if !net.IP(m.ResponseAddress).Equal(net.ParseIP(tc.ip)) || m.GetResponsePort() != tc.port {
+			t.Errorf("%s: expected %s port %d, got %v port %d", tc.addr, tc.ip, tc.port,
+				net.IP(m.ResponseAddress), m.GetResponsePort())
+		}
+	}
+}
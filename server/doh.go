@@ -0,0 +1,172 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	dohPath     = "/dns-query"
+	dohMimeType = "application/dns-message"
+)
+
+// dohHandler serves DNS-over-HTTPS (RFC 8484) requests by handing them to ServeDNS.
+// If trustProxy is true the client address is taken from the X-Forwarded-For header.
+type dohHandler struct {
+	s          *server
+	trustProxy bool
+}
+
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(buf) == 0 {
+			http.Error(w, "missing or malformed 'dns' parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != dohMimeType {
+			http.Error(w, fmt.Sprintf("unsupported content type '%s'", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, fmt.Sprintf("malformed DNS message: %s", err), http.StatusBadRequest)
+		return
+	}
+	if req.Response || len(req.Question) != 1 {
+		http.Error(w, "DNS message must be a query with exactly one question", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohResponseWriter{
+		localAddr:  localAddr(r),
+		remoteAddr: h.remoteAddr(r),
+		secure:     r.TLS != nil,
+	}
+	h.s.ServeDNS(dw, req)
+	if dw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	out, err := dw.msg.Pack()
+	if err != nil {
+		log.Errorf("[%d] Failed to pack DoH reply: %v", req.Id, err)
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMimeType)
+	if ttl, ok := minTTL(dw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(out)
+}
+
+func (h *dohHandler) remoteAddr(r *http.Request) net.Addr {
+	if h.trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			client := strings.TrimSpace(strings.Split(fwd, ",")[0])
+			if ip := net.ParseIP(client); ip != nil {
+				return &net.TCPAddr{IP: ip}
+			}
+		}
+	}
+	return parseTCPAddr(r.RemoteAddr)
+}
+
+func localAddr(r *http.Request) net.Addr {
+	if a, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return parseTCPAddr(a.String())
+	}
+	return &net.TCPAddr{}
+}
+
+// parseTCPAddr converts a host:port string to a *net.TCPAddr so that
+// ServeDNS treats DoH clients like clients of a stream transport.
+func parseTCPAddr(hostPort string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", hostPort)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// minTTL returns the lowest TTL found in the answer and authority sections.
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// dohResponseWriter implements dns.ResponseWriter for requests received over HTTP.
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	secure     bool // received over HTTPS rather than the plain HTTP listener
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.localAddr }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// dohMux returns the HTTP handler serving DoH requests at dohPath.
+func (s *server) dohMux(trustProxy bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, &dohHandler{s: s, trustProxy: trustProxy})
+	return mux
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type testHostfile map[string][]net.IP
+
+func (h testHostfile) FindHosts(name string) ([]net.IP, error) { return h[name], nil }
+func (h testHostfile) FindReverse(name string) (string, error) { return "", nil }
+
+func newTestDoHMux() http.Handler {
+	config := &Config{DnsAddr: "127.0.0.1:0", NoRec: true, RCacheTtl: 60, Ndots: 1}
+	CheckConfig(config)
+	hosts := testHostfile{"doh.example.": {net.ParseIP("192.0.2.1")}}
+	s := New(hosts, config, "test")
+	return s.dohMux(false)
+}
+
+func newTestDoHServer() *httptest.Server {
+	return httptest.NewServer(newTestDoHMux())
+}
+
+func readDoHResponse(t *testing.T, resp *http.Response) *dns.Msg {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad status, expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMimeType {
+		t.Fatalf("bad content type, expected %s, got %s", dohMimeType, ct)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDoHGetAndPost(t *testing.T) {
+	ts := newTestDoHServer()
+	defer ts.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("doh.example.", dns.TypeA)
+	req.Id = 0
+	buf, _ := req.Pack()
+
+	resp, err := http.Get(ts.URL + dohPath + "?dns=" + base64.RawURLEncoding.EncodeToString(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := readDoHResponse(t, resp)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("bad answer, got %v", m.Answer)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=10" {
+		t.Fatalf("bad Cache-Control, expected max-age=10, got %s", cc)
+	}
+
+	resp, err = http.Post(ts.URL+dohPath, dohMimeType, bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m = readDoHResponse(t, resp); len(m.Answer) != 1 {
+		t.Fatalf("bad answer, got %v", m.Answer)
+	}
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	ts := newTestDoHServer()
+	defer ts.Close()
+
+	resp, _ := http.Get(ts.URL + dohPath + "?dns=%%%")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad status for malformed parameter, expected 400, got %d", resp.StatusCode)
+	}
+	resp, _ = http.Post(ts.URL+dohPath, "text/plain", bytes.NewReader([]byte("foo")))
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("bad status for wrong content type, expected 415, got %d", resp.StatusCode)
+	}
+}
+
+func TestDoHTransport(t *testing.T) {
+	responses := new(testVec)
+	StatsResponseCount = responses
+	defer func() { StatsResponseCount = nopVec{} }()
+
+	req := new(dns.Msg)
+	req.SetQuestion("doh.example.", dns.TypeA)
+	buf, _ := req.Pack()
+
+	for _, ts := range []*httptest.Server{httptest.NewTLSServer(newTestDoHMux()), httptest.NewServer(newTestDoHMux())} {
+		resp, err := ts.Client().Post(ts.URL+dohPath, dohMimeType, bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		readDoHResponse(t, resp)
+		ts.Close()
+	}
+
+	expected := []string{"A,NOERROR,https", "A,NOERROR,http"}
+	if !reflect.DeepEqual(responses.labels, expected) {
+		t.Fatalf("expected responses %v, got %v", expected, responses.labels)
+	}
+}
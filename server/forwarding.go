@@ -5,26 +5,30 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
 )
 
+var errDeadline = errors.New("time budget for query exceeded")
+
 // ServeDNSForward resolves a query by forwarding to a recursive nameserver
 func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	name := req.Question[0].Name
-	nameDots := dns.CountLabel(name)-1
+	nameDots := dns.CountLabel(name) - 1
 	refuse := false
 
 	switch {
-	case s.config.NoRec:
+	case s.config().NoRec:
 		log.Debugf("[%d] Refusing query, recursion disabled", req.Id)
 		refuse = true
-	case len(s.config.Nameservers) == 0:
+	case len(s.config().Nameservers) == 0:
 		log.Debugf("[%d] Refusing query, no nameservers configured", req.Id)
 		refuse = true
-	case nameDots < s.config.FwdNdots && !s.config.EnableSearch:
+	case nameDots < s.config().FwdNdots && !s.config().EnableSearch:
 		log.Debugf("[%d] Refusing query, qname '%s' too short to forward", req.Id, name)
 		refuse = true
 	}
@@ -32,28 +36,45 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	if refuse {
 		m := new(dns.Msg)
 		m.SetRcode(req, dns.RcodeRefused)
-		writeMsg(w, m)
+		writeFit(w, req, m, s.config().EdnsBufSize)
 		return m
 	}
 
 	StatsForwardCount.Inc(1)
+	if _, ok := s.stubZone(name); ok {
+		setSource(w, sourceStub)
+	} else {
+		setSource(w, sourceUpstream)
+	}
 
-    var searchEnabled, didAbsolute, didSearch bool
-	var absoluteRes, searchRes *dns.Msg // responses from absolute/search lookups
-	var absoluteErr, searchErr error // errors from absolute/search lookups
+	var searchEnabled, didAbsolute, didSearch bool
+	var absoluteRes, searchRes *dns.Msg  // responses from absolute/search lookups
+	var absoluteErr, searchErr error     // errors from absolute/search lookups
+	var absoluteTrace, searchTrace trace // nameservers and search domain of the responses
 
 	tcp := isTCP(w)
 
-	if s.config.EnableSearch && len(s.config.SearchDomains) > 0 {
+	// Limit the time spent on resolving this query
+	ctx := context.Background()
+	if s.config().FwdDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config().FwdDeadline)
+		defer cancel()
+	}
+
+	if s.config().EnableSearch && len(s.config().SearchDomains) > 0 {
 		searchEnabled = true
 	}
 
+	// Advertise our own EDNS0 buffer size to the nameservers
+	fwdReq := upstreamRequest(req, s.config().EdnsBufSize)
+
 	// If there are enough dots in the name, start with trying to
 	// resolve the literal name
-	if nameDots >= s.config.Ndots {
-		if nameDots >= s.config.FwdNdots {
+	if nameDots >= s.config().Ndots {
+		if nameDots >= s.config().FwdNdots {
 			log.Debugf("[%d] Doing initial absolute lookup", req.Id)
-			absoluteRes, absoluteErr = s.forwardQuery(req, tcp)
+			absoluteRes, absoluteErr = s.forwardQuery(withTrace(ctx, &absoluteTrace), fwdReq, tcp)
 			if absoluteErr != nil {
 				log.Errorf("[%d] Error looking up literal qname '%s' with upstreams: %v", req.Id, name, absoluteErr)
 			}
@@ -63,7 +84,8 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 					req.Id, dns.RcodeToString[absoluteRes.Rcode])
 				absoluteRes.Compress = true
 				absoluteRes.Id = req.Id
-				writeMsg(w, absoluteRes)
+				setTrace(w, absoluteTrace)
+				writeFit(w, req, absoluteRes, s.config().EdnsBufSize)
 				return absoluteRes
 			}
 			didAbsolute = true
@@ -76,7 +98,7 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	// and we didn't previously fail to query the upstreams
 	if absoluteErr == nil && searchEnabled {
 		log.Debugf("[%d] Doing search lookup", req.Id)
-		searchRes, searchErr = s.forwardSearch(req, tcp)
+		searchRes, searchErr = s.forwardSearch(withTrace(ctx, &searchTrace), fwdReq, tcp)
 		if searchErr != nil {
 			log.Errorf("[%d] Error looking up qname '%s' with search: %v", req.Id, name, searchErr)
 		}
@@ -86,7 +108,8 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 				req.Id, dns.RcodeToString[searchRes.Rcode])
 			searchRes.Compress = true
 			searchRes.Id = req.Id
-			writeMsg(w, searchRes)
+			setTrace(w, searchTrace)
+			writeFit(w, req, searchRes, s.config().EdnsBufSize)
 			return searchRes
 		}
 		didSearch = true
@@ -96,9 +119,9 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	// if there are enough dots in the name and searching did
 	// not previously fail
 	if searchErr == nil && !didAbsolute {
-		if nameDots >= s.config.FwdNdots {
+		if nameDots >= s.config().FwdNdots {
 			log.Debugf("[%d] Doing absolute lookup", req.Id)
-			absoluteRes, absoluteErr = s.forwardQuery(req, tcp)
+			absoluteRes, absoluteErr = s.forwardQuery(withTrace(ctx, &absoluteTrace), fwdReq, tcp)
 			if absoluteErr != nil {
 				log.Errorf("[%d] Error resolving literal qname '%s': %v", req.Id, name, absoluteErr)
 			}
@@ -108,7 +131,8 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 					req.Id, dns.RcodeToString[absoluteRes.Rcode])
 				absoluteRes.Compress = true
 				absoluteRes.Id = req.Id
-				writeMsg(w, absoluteRes)
+				setTrace(w, absoluteTrace)
+				writeFit(w, req, absoluteRes, s.config().EdnsBufSize)
 				return absoluteRes
 			}
 			didAbsolute = true
@@ -122,19 +146,21 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	// a no-data response with the rcode from the last search we did.
 	if didAbsolute && absoluteErr == nil {
 		log.Debugf("[%d] Failed to resolve query. Returning response of absolute lookup: %s",
-					req.Id, dns.RcodeToString[absoluteRes.Rcode])
+			req.Id, dns.RcodeToString[absoluteRes.Rcode])
 		absoluteRes.Compress = true
 		absoluteRes.Id = req.Id
-		writeMsg(w, absoluteRes)
+		setTrace(w, absoluteTrace)
+		writeFit(w, req, absoluteRes, s.config().EdnsBufSize)
 		return absoluteRes
 	}
 
 	if didSearch && searchErr == nil {
 		log.Debugf("[%d] Failed to resolve query. Returning no-data response: %s",
-					req.Id, dns.RcodeToString[searchRes.Rcode])
+			req.Id, dns.RcodeToString[searchRes.Rcode])
 		m := new(dns.Msg)
 		m.SetRcode(req, searchRes.Rcode)
-		writeMsg(w, m)
+		setTrace(w, searchTrace)
+		writeFit(w, req, m, s.config().EdnsBufSize)
 		return m
 	}
 
@@ -143,40 +169,51 @@ func (s *server) ServeDNSForward(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	log.Debugf("[%d] Error forwarding query. Returning SRVFAIL.", req.Id)
 	m := new(dns.Msg)
 	m.SetRcode(req, dns.RcodeServerFailure)
-	writeMsg(w, m)
+	writeFit(w, req, m, s.config().EdnsBufSize)
 	return m
 }
 
-// forwardSearch resolves a query by suffixing with search paths
-func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
+// forwardSearch resolves a query by suffixing with search paths. Searching
+// stops when the deadline of ctx is exceeded.
+func (s *server) forwardSearch(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	var r *dns.Msg
-	var nodata *dns.Msg // stores the copy of a NODATA reply
+	var nodata *dns.Msg   // stores the copy of a NODATA reply
 	var searchName string // stores the current name suffixed with search domain
 	var err error
 	var didSearch bool
+	var nodataTrace trace        // forwarding details of the NODATA reply
 	name := req.Question[0].Name // original qname
 	reqCopy := req.Copy()
+	t := traceFrom(ctx)
 
-	for _, domain := range s.config.SearchDomains {
+	for _, domain := range s.config().SearchDomains {
 		if strings.HasSuffix(name, domain) {
 			continue
 		}
 
+		if ctx.Err() != nil {
+			log.Debugf("[%d] Time budget exceeded, stopping search at domain '%s'", req.Id, domain)
+			err = errDeadline
+			break
+		}
+
 		searchName = strings.ToLower(appendDomain(name, domain))
 		reqCopy.Question[0] = dns.Question{searchName, reqCopy.Question[0].Qtype, reqCopy.Question[0].Qclass}
 		didSearch = true
-		r, err = s.forwardQuery(reqCopy, tcp)
+		r, err = s.forwardQuery(ctx, reqCopy, tcp)
 		if err != nil {
 			// No server currently available, give up
 			break
 		}
+		t.searchDomain = domain
 
 		switch r.Rcode {
 		case dns.RcodeSuccess:
-			// In case of NO_DATA keep searching, otherwise a wildcard entry 
+			// In case of NO_DATA keep searching, otherwise a wildcard entry
 			// could keep us from finding the answer higher in the search list
 			if len(r.Answer) == 0 && !r.MsgHdr.Truncated {
 				nodata = r.Copy()
+				nodataTrace = *t
 				continue
 			}
 		case dns.RcodeNameError:
@@ -189,7 +226,7 @@ func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 		break
 	}
 
-	if !didSearch {
+	if !didSearch && err == nil {
 		m := new(dns.Msg)
 		m.SetRcode(req, dns.RcodeNameError)
 		return m, nil
@@ -207,9 +244,10 @@ func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 				}
 				r.Answer = answers
 			}
-		// If we ever got a NODATA, return this instead of a negative result
+			// If we ever got a NODATA, return this instead of a negative result
 		} else if nodata != nil {
 			r = nodata
+			*t = nodataTrace
 		}
 		// Restore original question
 		r.Question[0] = req.Question[0]
@@ -217,6 +255,7 @@ func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 
 	if err != nil && nodata != nil {
 		r = nodata
+		*t = nodataTrace
 		r.Question[0] = req.Question[0]
 		err = nil
 	}
@@ -224,49 +263,51 @@ func (s *server) forwardSearch(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	return r, err
 }
 
-// forwardQuery sends the query to nameservers retrying once on error
-func (s *server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
+// forwardQuery sends the query to nameservers, making up to FwdAttempts
+// attempts within the deadline of ctx.
+func (s *server) forwardQuery(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	var nservers []string // Nameservers to use for this query
 	var nsIdx int
 	var r *dns.Msg
 	var err error
 
-	nservers = s.config.Nameservers
+	nservers = s.config().Nameservers
+	strategy := s.config().UpstreamStrategy
 
 	// Check whether the name matches a stub zone
-	for zone, srv := range *s.config.Stub {
-		if strings.HasSuffix(req.Question[0].Name, zone) {
-			nservers = srv
-			StatsStubForwardCount.Inc(1)
-			break
+	if zone, ok := s.stubZone(req.Question[0].Name); ok {
+		nservers = (*s.config().Stub)[zone]
+		if st, ok := s.config().StubStrategy[zone]; ok {
+			strategy = st
 		}
+		StatsStubForwardCount.Inc(1)
+	}
+
+	// Skip nameservers marked down by health checking
+	nservers = s.orderUpstreams(s.healthyUpstreams(nservers), strategy)
+
+	if strategy == StrategyParallel {
+		return s.forwardParallel(ctx, req, tcp, nservers)
 	}
 
-	for try := 1; try <= 2; try++ {
+	for try := 1; try <= s.config().FwdAttempts; try++ {
+		if ctx.Err() != nil {
+			log.Debugf("[%d] Time budget exceeded after %d attempts", req.Id, try-1)
+			if r == nil {
+				err = errDeadline
+			}
+			break
+		}
+
 		log.Debugf("[%d] Querying upstream %s for qname '%s'",
 			req.Id, nservers[nsIdx], req.Question[0].Name)
 
-		switch tcp {
-		case false:
-			r, _, err = s.dnsUDPclient.Exchange(req, nservers[nsIdx])
-		case true:
-			r, _, err = s.dnsTCPclient.Exchange(req, nservers[nsIdx])
-		}
+		r, err = s.exchange(ctx, nservers[nsIdx], req, tcp)
 
 		if err == nil {
+			traceFrom(ctx).upstream = nservers[nsIdx]
 			log.Debugf("[%d] Response code from upstream: %s", req.Id, dns.RcodeToString[r.Rcode])
-			switch r.Rcode {
-			// SUCCESS
-			case dns.RcodeSuccess:
-				fallthrough
-			case dns.RcodeNameError:
-				fallthrough
-			// NO RECOVERY
-			case dns.RcodeFormatError:
-				fallthrough
-			case dns.RcodeRefused:
-				fallthrough
-			case dns.RcodeNotImplemented:
+			if finalRcode(r.Rcode) {
 				return r, err
 			}
 		}
@@ -287,6 +328,16 @@ func (s *server) forwardQuery(req *dns.Msg, tcp bool) (*dns.Msg, error) {
 	return r, err
 }
 
+// stubZone returns the stub zone the name belongs to.
+func (s *server) stubZone(name string) (string, bool) {
+	for zone := range *s.config().Stub {
+		if strings.HasSuffix(name, zone) {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
 // ServeDNSReverse is the handler for DNS requests for the reverse zone. If nothing is found
 // locally the request is forwarded to the forwarder for resolution.
 func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
@@ -296,14 +347,36 @@ func (s *server) ServeDNSReverse(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
 	m.Authoritative = false
 	m.RecursionAvailable = true
 	if records, err := s.PTRRecords(req.Question[0]); err == nil && len(records) > 0 {
+		setSource(w, sourceHosts)
 		m.Answer = records
-		writeMsg(w, m)
+		writeFit(w, req, m, s.config().EdnsBufSize)
+		return m
+	}
+	if s.config().BogusPriv && isPrivateReverse(req.Question[0].Name) {
+		log.Debugf("[%d] Not forwarding reverse lookup for private address", req.Id)
+		setSource(w, sourceStatic)
+		m.SetRcode(req, dns.RcodeNameError)
+		writeFit(w, req, m, s.config().EdnsBufSize)
 		return m
 	}
 	// Always forward if not found locally.
 	return s.ServeDNSForward(w, req)
 }
 
+// writeFit writes the response to req with the OPT record set for the client.
+// If it exceeds the client's buffer size a trimmed copy is sent, leaving the
+// full message intact for caching.
+func writeFit(w dns.ResponseWriter, req, m *dns.Msg, ednsBufSize uint16) {
+	setEdns0(m, req, ednsBufSize)
+	tcp := isTCP(w)
+	if bufsize := clientBufSize(req, tcp); m.Len() > bufsize {
+		m1, _ := Fit(m.Copy(), bufsize, tcp)
+		writeMsg(w, m1)
+		return
+	}
+	writeMsg(w, m)
+}
+
 func writeMsg(w dns.ResponseWriter, m *dns.Msg) {
 	if err := w.WriteMsg(m); err != nil {
 		log.Errorf("[%d] Failed to return reply: %v", m.Id, err)
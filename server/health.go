@@ -0,0 +1,157 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// upstreamHealth is the health state of an upstream nameserver.
+type upstreamHealth struct {
+	failures int       // consecutive failed probes
+	down     bool      // whether the upstream is skipped when forwarding
+	since    time.Time // time of the last state change
+}
+
+// isUp returns false if health checking marked the upstream as down.
+func (s *server) isUp(addr string) bool {
+	s.healthMu.RLock()
+	defer s.healthMu.RUnlock()
+	if h, ok := s.health[addr]; ok {
+		return !h.down
+	}
+	return true
+}
+
+// healthyUpstreams returns the nameservers that are not marked down. If all of
+// them are down the full list is returned, so that queries are still attempted.
+func (s *server) healthyUpstreams(nservers []string) []string {
+	var healthy []string
+	for _, ns := range nservers {
+		if s.isUp(ns) {
+			healthy = append(healthy, ns)
+		}
+	}
+	if len(healthy) == 0 {
+		return nservers
+	}
+	return healthy
+}
+
+// allUpstreams returns the configured nameservers and stub zone servers.
+func (s *server) allUpstreams() []string {
+	seen := make(map[string]bool)
+	var all []string
+	add := func(nservers []string) {
+		for _, ns := range nservers {
+			if !seen[ns] {
+				seen[ns] = true
+				all = append(all, ns)
+			}
+		}
+	}
+	add(s.config().Nameservers)
+	if s.config().Stub != nil {
+		for _, nservers := range *s.config().Stub {
+			add(nservers)
+		}
+	}
+	return all
+}
+
+// runHealthChecks periodically probes all upstreams until stop is closed.
+func (s *server) runHealthChecks(stop <-chan struct{}) {
+	interval := time.Duration(s.config().HealthCheckInterval) * time.Second
+	log.Infof("Health checking upstreams every %s (probe: '%s NS')", interval, s.config().HealthCheckName)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, addr := range s.allUpstreams() {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				s.updateHealth(addr, s.probe(addr))
+			}(addr)
+		}
+		wg.Wait()
+	}
+}
+
+// probe sends the health check query to the upstream. Probes bypass
+// exchange, so they don't count as forwarded queries in the response times
+// and the upstream stats.
+func (s *server) probe(addr string) error {
+	u, err := s.upstream(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().FwdTimeout)
+	defer cancel()
+	m := new(dns.Msg)
+	m.SetQuestion(s.config().HealthCheckName, dns.TypeNS)
+	r, _, err := u.Exchange(ctx, m, false)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return fmt.Errorf("Unhealthy response code %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+// updateHealth records the result of a probe, marking the upstream down after
+// HealthCheckFailures consecutive failures and up again after a successful probe.
+func (s *server) updateHealth(addr string, err error) {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	h, ok := s.health[addr]
+	if !ok {
+		h = &upstreamHealth{since: time.Now()}
+		s.health[addr] = h
+	}
+	defer func() {
+		if h.down {
+			StatsUpstreamHealthy.Set(0, addr)
+		} else {
+			StatsUpstreamHealthy.Set(1, addr)
+		}
+	}()
+
+	if err == nil {
+		if h.down {
+			log.Infof("Upstream %s is up again after %s", addr, time.Since(h.since))
+			StatsUpstreamUpCount.Inc(1)
+			h.down = false
+			h.since = time.Now()
+		}
+		h.failures = 0
+		return
+	}
+
+	StatsUpstreamProbeFailCount.Inc(1)
+	h.failures++
+	log.Debugf("Health check of upstream %s failed (%d/%d): %v",
+		addr, h.failures, s.config().HealthCheckFailures, err)
+	if !h.down && h.failures >= s.config().HealthCheckFailures {
+		log.Warnf("Upstream %s is down after %d failed health checks", addr, h.failures)
+		StatsUpstreamDownCount.Inc(1)
+		h.down = true
+		h.since = time.Now()
+	}
+}
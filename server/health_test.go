@@ -0,0 +1,81 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamHealth(t *testing.T) {
+	config := &Config{DnsAddr: "127.0.0.1:0", NoRec: true, RCacheTtl: 60, Ndots: 1, HealthCheckFailures: 2}
+	CheckConfig(config)
+	s := New(testHostfile{}, config, "test")
+
+	nservers := []string{"192.0.2.1:53", "192.0.2.2:53"}
+	errProbe := errors.New("probe failed")
+
+	s.updateHealth(nservers[0], errProbe)
+	if !s.isUp(nservers[0]) {
+		t.Fatal("upstream expected to be up after a single failure")
+	}
+	s.updateHealth(nservers[0], errProbe)
+	if s.isUp(nservers[0]) {
+		t.Fatal("upstream expected to be down after reaching the failure threshold")
+	}
+	if healthy := s.healthyUpstreams(nservers); !reflect.DeepEqual(healthy, nservers[1:]) {
+		t.Fatalf("bad healthy upstreams, expected %v, got %v", nservers[1:], healthy)
+	}
+
+	// All upstreams down, fall back to trying all of them
+	s.updateHealth(nservers[1], errProbe)
+	s.updateHealth(nservers[1], errProbe)
+	if healthy := s.healthyUpstreams(nservers); !reflect.DeepEqual(healthy, nservers) {
+		t.Fatalf("bad healthy upstreams, expected %v, got %v", nservers, healthy)
+	}
+
+	s.updateHealth(nservers[0], nil)
+	if !s.isUp(nservers[0]) {
+		t.Fatal("upstream expected to be up again after a successful probe")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen on udp: %v", err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	queries := new(testVec)
+	StatsUpstreamQueryCount = queries
+	defer func() { StatsUpstreamQueryCount = nopVec{} }()
+
+	config := &Config{DnsAddr: "127.0.0.1:0", NoRec: true, RCacheTtl: 60, Ndots: 1}
+	CheckConfig(config)
+	s := New(testHostfile{}, config, "test")
+
+	addr := pc.LocalAddr().String()
+	if err := s.probe(addr); err != nil {
+		t.Fatal(err)
+	}
+	// Probes are not forwarded queries
+	if len(queries.labels) != 0 {
+		t.Fatalf("expected no upstream queries, got %v", queries.labels)
+	}
+	if _, ok := s.srtt[addr]; ok {
+		t.Fatal("expected probes not to update the response time")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Address ranges for which reverse lookups are not forwarded with BogusPriv.
+var privateNets = parseCIDRs(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+	"127.0.0.0/8", "169.254.0.0/16", "fc00::/7", "fe80::/10", "::1/128",
+)
+
+func parseCIDRs(cidrs ...string) (nets []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// staticAddresses returns the configured addresses of the closest domain the
+// name belongs to. ok is false if the name is not covered by Addresses.
+func (s *server) staticAddresses(name string) (ips []net.IP, ok bool) {
+	best := -1
+	for domain, addrs := range s.config().Addresses {
+		if n := dns.CountLabel(domain); n > best && dns.IsSubDomain(domain, name) {
+			best = n
+			ips = ips[:0]
+			for _, addr := range addrs {
+				ips = append(ips, net.ParseIP(addr))
+			}
+		}
+	}
+	return ips, best >= 0
+}
+
+// isLocalDomain returns true if the name belongs to one of the LocalDomains.
+func (s *server) isLocalDomain(name string) bool {
+	for _, domain := range s.config().LocalDomains {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateReverse returns true if name is the reverse lookup name of a
+// private address.
+func isPrivateReverse(name string) bool {
+	ip := reverseIP(name)
+	if ip == nil {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseIP returns the address of an in-addr.arpa or ip6.arpa name, or nil
+// if the name doesn't denote a complete address.
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			b, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(b)
+		}
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 32 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			b, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			// labels are in reverse order, least significant nibble first
+			n := 31 - i
+			ip[n/2] |= byte(b) << uint(4*(1-n%2))
+		}
+		return ip
+	}
+	return nil
+}
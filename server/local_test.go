@@ -0,0 +1,86 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseIP(t *testing.T) {
+	testcases := []struct {
+		name string
+		ip   string
+	}{
+		{"1.0.168.192.in-addr.arpa.", "192.168.0.1"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", "::1"},
+		{"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", "4321:0:1:2:3:4:567:89ab"},
+		{"0.168.192.in-addr.arpa.", ""},
+		{"300.0.168.192.in-addr.arpa.", ""},
+		{"example.com.", ""},
+	}
+	for _, tc := range testcases {
+		ip := reverseIP(tc.name)
+		if tc.ip == "" {
+			if ip != nil {
+				t.Errorf("reverseIP(%q): expected nil, got %s", tc.name, ip)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(tc.ip)) {
+			t.Errorf("reverseIP(%q): expected %s, got %s", tc.name, tc.ip, ip)
+		}
+	}
+
+	if !isPrivateReverse("1.0.168.192.in-addr.arpa.") {
+		t.Error("expected 192.168.0.1 to be private")
+	}
+	if isPrivateReverse("8.8.8.8.in-addr.arpa.") {
+		t.Error("expected 8.8.8.8 not to be private")
+	}
+}
+
+func TestServeDNSLocal(t *testing.T) {
+	config := &Config{
+		DnsAddr:      "127.0.0.1:0",
+		RCacheTtl:    60,
+		Ndots:        1,
+		Nameservers:  []string{"127.0.0.1:1"},
+		Addresses:    map[string][]string{"ads.example.": {"0.0.0.0"}, "nx.example.": {}},
+		LocalDomains: []string{"lan."},
+		BogusPriv:    true,
+	}
+	CheckConfig(config)
+	hosts := testHostfile{"printer.lan.": {net.ParseIP("192.0.2.1")}}
+	s := New(hosts, config, "test")
+
+	testcases := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+	}{
+		{"ads.example.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"tracker.ads.example.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"ads.example.", dns.TypeAAAA, dns.RcodeSuccess, 0},
+		{"badads.example.", dns.TypeA, dns.RcodeServerFailure, 0},
+		{"nx.example.", dns.TypeA, dns.RcodeNameError, 0},
+		{"printer.lan.", dns.TypeA, dns.RcodeSuccess, 1},
+		{"scanner.lan.", dns.TypeA, dns.RcodeNameError, 0},
+		{"1.0.168.192.in-addr.arpa.", dns.TypePTR, dns.RcodeNameError, 0},
+	}
+	for _, tc := range testcases {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, tc.qtype)
+		w := new(testWriter)
+		s.ServeDNS(w, req)
+		if w.msg.Rcode != tc.rcode || len(w.msg.Answer) != tc.answers {
+			t.Errorf("%s %s: expected %s with %d answers, got %s with %d answers", tc.name, dns.TypeToString[tc.qtype],
+				dns.RcodeToString[tc.rcode], tc.answers, dns.RcodeToString[w.msg.Rcode], len(w.msg.Answer))
+		}
+	}
+}
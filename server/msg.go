@@ -6,6 +6,72 @@ package server
 
 import "github.com/miekg/dns"
 
+// EDNS0 buffer size advertised to clients and nameservers by default, as
+// recommended by DNS flag day 2020 to avoid IP fragmentation.
+const defaultEdnsBufSize = 1232
+
+// clientBufSize returns the size of the largest response the client accepts.
+func clientBufSize(req *dns.Msg, tcp bool) int {
+	// with TCP we can send 64K
+	if tcp {
+		return dns.MaxMsgSize - 1
+	}
+	if o := req.IsEdns0(); o != nil && o.UDPSize() > 512 {
+		return int(o.UDPSize())
+	}
+	return 512
+}
+
+// setEdns0 sets the OPT record of the response m to match the request. Any OPT
+// record already present (e.g. from a nameserver) is removed. If the client
+// sent an OPT record, a new one advertising our own buffer size is added with
+// the DO bit echoed, otherwise extended rcodes can't be sent and are replaced
+// by SERVFAIL.
+func setEdns0(m, req *dns.Msg, bufsize uint16) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+
+	o := req.IsEdns0()
+	if o == nil {
+		if m.Rcode > 0xF {
+			m.Rcode = dns.RcodeServerFailure
+		}
+		return
+	}
+	m.SetEdns0(bufsize, o.Do())
+}
+
+// upstreamRequest returns a copy of req to send to the nameservers with a new
+// OPT record advertising our own EDNS0 buffer size. The DO bit and the client
+// subnet option of the client are kept, other options such as cookies,
+// keepalive and padding only apply to the connection with the client.
+func upstreamRequest(req *dns.Msg, bufsize uint16) *dns.Msg {
+	r := req.Copy()
+	o := r.IsEdns0()
+	extra := r.Extra[:0]
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	r.Extra = extra
+	r.SetEdns0(bufsize, o != nil && o.Do())
+	if o != nil {
+		opt := r.IsEdns0()
+		for _, e := range o.Option {
+			if e.Option() == dns.EDNS0SUBNET {
+				opt.Option = append(opt.Option, e)
+			}
+		}
+	}
+	return r
+}
+
 // Fit will make m fit the size. If a message is larger than size then entire
 // additional section is dropped. If it is still to large and the transport
 // is udp we return a truncated message.
@@ -13,8 +79,12 @@ import "github.com/miekg/dns"
 // until it fits. When this is case the returned bool is true.
 func Fit(m *dns.Msg, size int, tcp bool) (*dns.Msg, bool) {
 	if m.Len() > size {
-		// Check for OPT Records at the end and keep those. TODO(miek)
+		// Drop the additional section, but keep the OPT record
+		opt := m.IsEdns0()
 		m.Extra = nil
+		if opt != nil {
+			m.Extra = []dns.RR{opt}
+		}
 	}
 	if m.Len() < size {
 		return m, false
@@ -0,0 +1,133 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testWriter records the message written by a handler.
+type testWriter struct {
+	msg *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+func (w *testWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testWriter) Close() error                { return nil }
+func (w *testWriter) TsigStatus() error           { return nil }
+func (w *testWriter) TsigTimersOnly(bool)         {}
+func (w *testWriter) Hijack()                     {}
+
+func TestFitKeepsOPT(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.", dns.TypeA)
+	for i := 0; i < 60; i++ {
+		m.Answer = append(m.Answer, newA(fmt.Sprintf("example. 3600 IN A 192.0.2.%d", i)))
+		m.Extra = append(m.Extra, newA(fmt.Sprintf("ns%d.example. 3600 IN A 192.0.2.%d", i, i)))
+	}
+	m.SetEdns0(4096, true)
+
+	Fit(m, 512, false)
+	if !m.Truncated {
+		t.Fatal("expected truncated message")
+	}
+	if len(m.Extra) != 1 || m.IsEdns0() == nil {
+		t.Fatalf("expected only the OPT record in additional section, got %v", m.Extra)
+	}
+	if m.Len() > 512 {
+		t.Fatalf("message does not fit, got %d bytes", m.Len())
+	}
+}
+
+func TestSetEdns0(t *testing.T) {
+	// Response from upstream carrying its own OPT record
+	upstream := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		return m
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	m := upstream()
+	setEdns0(m, req, 1232)
+	if m.IsEdns0() != nil {
+		t.Fatalf("expected no OPT record for non-EDNS client, got %v", m.Extra)
+	}
+
+	req.SetEdns0(4096, true)
+	m = upstream()
+	setEdns0(m, req, 1232)
+	if len(m.Extra) != 1 {
+		t.Fatalf("expected exactly one OPT record, got %v", m.Extra)
+	}
+	if o := m.IsEdns0(); o.UDPSize() != 1232 || !o.Do() {
+		t.Fatalf("expected OPT with size 1232 and DO bit, got %v", o)
+	}
+}
+
+func TestUpstreamRequest(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	if o := upstreamRequest(req, 1232).IsEdns0(); o == nil || o.UDPSize() != 1232 || o.Do() {
+		t.Fatalf("expected OPT with size 1232, got %v", o)
+	}
+	if req.IsEdns0() != nil {
+		t.Fatal("original request was modified")
+	}
+
+	req.SetEdns0(512, true)
+	if o := upstreamRequest(req, 1232).IsEdns0(); o.UDPSize() != 1232 || !o.Do() {
+		t.Fatalf("expected OPT with size 1232 and DO bit, got %v", o)
+	}
+
+	// Hop-by-hop options of the client aren't forwarded, the client subnet is
+	opt := req.IsEdns0()
+	opt.Option = []dns.EDNS0{
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+		&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 8)},
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()},
+	}
+	o := upstreamRequest(req, 1232).IsEdns0()
+	if len(o.Option) != 1 || o.Option[0].Option() != dns.EDNS0SUBNET {
+		t.Fatalf("expected only the client subnet option, got %v", o.Option)
+	}
+	if len(opt.Option) != 4 {
+		t.Fatal("original request was modified")
+	}
+}
+
+func TestServeDNSBadVers(t *testing.T) {
+	s := newTestStrategyServer()
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().SetVersion(1)
+
+	w := new(testWriter)
+	s.ServeDNS(w, req)
+	if w.msg == nil {
+		t.Fatal("no response written")
+	}
+	if w.msg.Rcode != dns.RcodeBadVers {
+		t.Fatalf("expected BADVERS, got %s", dns.RcodeToString[w.msg.Rcode])
+	}
+	if o := w.msg.IsEdns0(); o == nil || o.Version() != 0 {
+		t.Fatalf("expected OPT record with version 0, got %v", o)
+	}
+	if _, err := w.msg.Pack(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Query log formats
+const (
+	QueryLogJSON   = "json"
+	QueryLogLogfmt = "logfmt"
+)
+
+// queryRecord is the query log record of a client query.
+type queryRecord struct {
+	Time         time.Time
+	Client       string
+	Transport    string
+	Name         string
+	Type         string
+	Rcode        string
+	Answers      int
+	Source       string
+	Upstream     string
+	SearchDomain string
+	Duration     time.Duration
+}
+
+// jsonQueryRecord is the query log record in the JSON format.
+type jsonQueryRecord struct {
+	Time         string  `json:"time"`
+	Client       string  `json:"client"`
+	Transport    string  `json:"transport"`
+	Name         string  `json:"qname"`
+	Type         string  `json:"qtype"`
+	Rcode        string  `json:"rcode"`
+	Answers      int     `json:"answers"`
+	Source       string  `json:"source"`
+	Upstream     string  `json:"upstream"`
+	SearchDomain string  `json:"search_domain"`
+	Duration     float64 `json:"duration_ms"`
+}
+
+// fields returns the keys and values of the record in logging order.
+func (r *queryRecord) fields() ([]string, []interface{}) {
+	return []string{"time", "client", "transport", "qname", "qtype", "rcode", "answers",
+			"source", "upstream", "search_domain", "duration_ms"},
+		[]interface{}{r.Time.Format(time.RFC3339Nano), r.Client, r.Transport, r.Name, r.Type, r.Rcode, r.Answers,
+			r.Source, r.Upstream, r.SearchDomain, float64(r.Duration) / float64(time.Millisecond)}
+}
+
+// format returns the record as one line in the given format.
+func (r *queryRecord) format(format string) []byte {
+	if format == QueryLogJSON {
+		line, _ := json.Marshal(&jsonQueryRecord{
+			Time:         r.Time.Format(time.RFC3339Nano),
+			Client:       r.Client,
+			Transport:    r.Transport,
+			Name:         r.Name,
+			Type:         r.Type,
+			Rcode:        r.Rcode,
+			Answers:      r.Answers,
+			Source:       r.Source,
+			Upstream:     r.Upstream,
+			SearchDomain: r.SearchDomain,
+			Duration:     float64(r.Duration) / float64(time.Millisecond),
+		})
+		return append(line, '\n')
+	}
+
+	var buf bytes.Buffer
+	keys, values := r.fields()
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(values[i]))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func logfmtValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		if v == "" || strings.ContainsAny(v, " =\"\\") || strings.IndexFunc(v, func(r rune) bool { return r < ' ' }) >= 0 {
+			return strconv.Quote(v)
+		}
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// queryLog writes query records to a file, stdout or syslog.
+type queryLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+}
+
+// openQueryLog opens the query log configured in config. It returns nil if
+// the query log is disabled.
+func openQueryLog(config *Config) (*queryLog, error) {
+	var out io.Writer
+	switch config.QueryLog {
+	case "":
+		return nil, nil
+	case "stdout", "-":
+		out = os.Stdout
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "go-dnsmasq")
+		if err != nil {
+			return nil, err
+		}
+		out = w
+	default:
+		f, err := openRotatingFile(config.QueryLog, int64(config.QueryLogMaxSize)<<20, config.QueryLogBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	return &queryLog{out: out, format: config.QueryLogFormat}, nil
+}
+
+func (l *queryLog) log(r *queryRecord) {
+	line := r.format(l.format)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+func (l *queryLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.out.(io.Closer); ok && l.out != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// rotatingFile is a file that is renamed to path.1 once it exceeds maxSize,
+// shifting older files up to path.backups. Without backups it is truncated.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	f      *os.File
+	size   int64
+	reopen bool // the file was renamed but creating a new one failed
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.reopen || r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		failing := r.reopen
+		if err := r.rotate(); err != nil && !failing {
+			log.Warnf("Failed to rotate query log %s: %s", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate starts a new file. If it can't be created, writing continues to the
+// renamed file and the next write tries again.
+func (r *rotatingFile) rotate() error {
+	if r.backups == 0 {
+		if err := r.f.Truncate(0); err != nil {
+			return err
+		}
+		r.size = 0
+		return nil
+	}
+	if !r.reopen {
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+		r.reopen = true
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	old.Close()
+	r.reopen = false
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// trace records which nameserver and search domain produced a response.
+type trace struct {
+	upstream     string
+	searchDomain string
+}
+
+type traceKey struct{}
+
+// withTrace returns a context that records forwarding details in t.
+func withTrace(ctx context.Context, t *trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceFrom returns the trace of ctx, or a discarded one if there is none.
+func traceFrom(ctx context.Context) *trace {
+	if t, ok := ctx.Value(traceKey{}).(*trace); ok {
+		return t
+	}
+	return new(trace)
+}
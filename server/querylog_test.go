@@ -0,0 +1,210 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryRecordFormat(t *testing.T) {
+	r := &queryRecord{
+		Time:         time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Client:       "127.0.0.1:40000",
+		Transport:    "udp",
+		Name:         "host.",
+		Type:         "A",
+		Rcode:        "NOERROR",
+		Answers:      2,
+		Source:       "upstream",
+		Upstream:     "192.0.2.1:53",
+		SearchDomain: "example.com.",
+		Duration:     1500 * time.Microsecond,
+	}
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(r.format(QueryLogJSON), &values); err != nil {
+		t.Fatal(err)
+	}
+	if values["qname"] != "host." || values["answers"] != 2.0 || values["duration_ms"] != 1.5 ||
+		values["search_domain"] != "example.com." || values["time"] != "2016-01-02T03:04:05Z" {
+		t.Fatalf("unexpected JSON record: %v", values)
+	}
+
+	expected := `time=2016-01-02T03:04:05Z client=127.0.0.1:40000 transport=udp qname=host. qtype=A ` +
+		`rcode=NOERROR answers=2 source=upstream upstream=192.0.2.1:53 search_domain=example.com. duration_ms=1.500` + "\n"
+	if line := string(r.format(QueryLogLogfmt)); line != expected {
+		t.Fatalf("expected %q, got %q", expected, line)
+	}
+
+	r.Upstream, r.Name = "", `a b"c.`
+	if line := string(r.format(QueryLogLogfmt)); !strings.Contains(line, `qname="a b\"c." `) ||
+		!strings.Contains(line, ` upstream="" `) {
+		t.Fatalf("expected quoted values, got %q", line)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "query.log")
+
+	f, err := openRotatingFile(path, 25, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{"first line\n", "second line\n", "third line\n", "fourth line\n",
+		"fifth line\n", "sixth line\n", "seventh line\n"}
+	for _, line := range lines {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	expected := map[string]string{
+		path:        "seventh line\n",
+		path + ".1": "fifth line\nsixth line\n",
+		path + ".2": "third line\nfourth line\n",
+	}
+	for name, content := range expected {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s: expected %q, got %q", name, content, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, got %v", err)
+	}
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "query.log")
+
+	f, err := openRotatingFile(path, 25, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"first line\n", "second line\n", "third line\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "third line\n" {
+		t.Errorf("expected the file to be truncated, got %q", data)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("expected no backup, got %v", err)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dnsmasq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "query.log")
+
+	f, err := openRotatingFile(path, 25, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("first line\n"))
+
+	// The file was rotated, but the new one can't be created
+	os.Rename(path, path+".1")
+	os.Mkdir(path, 0755)
+	f.reopen = true
+	if _, err := f.Write([]byte("second line\n")); err != nil {
+		t.Fatalf("expected to keep writing to the rotated file, got %v", err)
+	}
+
+	// The next write creates the file
+	os.Remove(path)
+	if _, err := f.Write([]byte("third line\n")); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		path:        "third line\n",
+		path + ".1": "first line\nsecond line\n",
+	}
+	for name, content := range expected {
+		if data, _ := ioutil.ReadFile(name); string(data) != content {
+			t.Errorf("%s: expected %q, got %q", name, content, data)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("expected the backups not to be shifted again, got %v", err)
+	}
+}
+
+func TestQueryLogSearchDomain(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen on udp: %v", err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Name == "host.example.com." {
+			m.Answer = []dns.RR{newA("host.example.com. 3600 IN A 192.0.2.1")}
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	addr := pc.LocalAddr().String()
+	config := &Config{
+		DnsAddr:       "127.0.0.1:0",
+		RCacheTtl:     60,
+		Ndots:         1,
+		Nameservers:   []string{addr},
+		EnableSearch:  true,
+		SearchDomains: []string{"example.org.", "example.com."},
+	}
+	CheckConfig(config)
+	s := New(testHostfile{}, config, "test")
+	var buf bytes.Buffer
+	s.qlog = &queryLog{out: &buf, format: QueryLogJSON}
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.", dns.TypeA)
+	s.ServeDNS(new(testWriter), req)
+
+	var values map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		t.Fatalf("%v: %s", err, buf.Bytes())
+	}
+	if values["source"] != sourceUpstream || values["upstream"] != addr || values["search_domain"] != "example.com." ||
+		values["rcode"] != "NOERROR" || values["answers"] != 2.0 || values["transport"] != "udp" {
+		t.Fatalf("unexpected record: %v", values)
+	}
+}
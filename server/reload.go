@@ -0,0 +1,89 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Config fields that can't be changed without restarting the server.
+var staticConfigFields = []string{
+	"DnsAddr", "TLSAddr", "DoHAddr", "DoHHTTPAddr", "TLSCertFile", "TLSKeyFile",
+	"DefaultResolver", "Systemd", "HealthCheckInterval", "RCache", "RCacheMaxSize", "RCacheTtl",
+	"MinCacheTtl", "MaxCacheTtl", "MaxNegCacheTtl", "ServfailCacheTtl", "StaleCacheTtl", "QueryLog",
+	"QueryLogFormat", "QueryLogMaxSize", "QueryLogBackups", "Dnstap", "AdminAddr", "PrometheusAddr",
+}
+
+// Reload replaces the configuration and hostsfile of the running server
+// without interrupting the listeners. The config must have been checked with
+// CheckConfig. Changes to fields that require a restart are ignored. If hosts
+// is nil the current hostsfile is kept, otherwise the old one is stopped.
+func (s *server) Reload(config *Config, hosts Hostfile) {
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+	old := s.config()
+
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(config).Elem()
+	for _, name := range staticConfigFields {
+		o, n := oldValue.FieldByName(name), newValue.FieldByName(name)
+		if !reflect.DeepEqual(o.Interface(), n.Interface()) {
+			log.Warnf("Changing '%s' requires a restart, keeping %v", name, o.Interface())
+			n.Set(o)
+		}
+	}
+
+	changed := false
+	for i := 0; i < newValue.NumField(); i++ {
+		o, n := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+		changed = true
+		if name := newValue.Type().Field(i).Name; name == "AdminToken" {
+			log.Infof("Config changed: %s", name)
+		} else {
+			log.Infof("Config changed: %s: %v -> %v", name, deref(o), deref(n))
+		}
+	}
+	if !changed {
+		log.Info("Config unchanged")
+	}
+
+	// Upstreams are set up with these settings, so they have to be recreated
+	if old.UpstreamCAFile != config.UpstreamCAFile || old.FwdTimeout != config.FwdTimeout {
+		s.closeUpstreams()
+	}
+
+	s.conf.Store(config)
+
+	if hosts != nil {
+		oldHosts := s.hostfile()
+		s.hosts.Store(hostsHolder{hosts})
+		if h, ok := oldHosts.(stopper); ok {
+			h.Stop()
+		}
+	}
+}
+
+// closeUpstreams closes and forgets all upstreams, they are recreated on the
+// next query.
+func (s *server) closeUpstreams() {
+	s.upstreamMu.Lock()
+	defer s.upstreamMu.Unlock()
+	for addr, u := range s.upstreams {
+		u.Close()
+		delete(s.upstreams, addr)
+	}
+}
+
+// deref returns the value a pointer points to, for logging.
+func deref(v interface{}) interface{} {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		return rv.Elem().Interface()
+	}
+	return v
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type testStoppableHostfile struct {
+	testHostfile
+	stopped bool
+}
+
+func (h *testStoppableHostfile) Stop() { h.stopped = true }
+
+func TestReload(t *testing.T) {
+	config := &Config{DnsAddr: "127.0.0.1:0", RCacheTtl: 60, Ndots: 1, ReadTimeout: time.Second}
+	CheckConfig(config)
+	oldHosts := &testStoppableHostfile{testHostfile: testHostfile{}}
+	s := New(oldHosts, config, "test")
+	s.upstreams["192.0.2.1:53"] = newPlainUpstream("192.0.2.1:53", time.Second)
+
+	newConfig := &Config{DnsAddr: "127.0.0.1:5353", NoRec: true, RCacheTtl: 60, Ndots: 1, FwdTimeout: 3 * time.Second}
+	CheckConfig(newConfig)
+	newHosts := testHostfile{"reload.example.": {net.ParseIP("192.0.2.1")}}
+	s.Reload(newConfig, newHosts)
+
+	if s.config().DnsAddr != "127.0.0.1:0" {
+		t.Fatalf("expected listen address to be kept, got %s", s.config().DnsAddr)
+	}
+	if !s.config().NoRec {
+		t.Fatal("expected NoRec to be reloaded")
+	}
+	if len(s.upstreams) != 0 {
+		t.Fatalf("expected upstreams to be recreated after timeout change, got %v", s.upstreams)
+	}
+	if !oldHosts.stopped {
+		t.Fatal("expected old hostsfile to be stopped")
+	}
+	if ips, _ := s.hostfile().FindHosts("reload.example."); len(ips) != 1 {
+		t.Fatalf("expected hostsfile to be replaced, got %v", ips)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	hosts "github.com/janeczku/go-dnsmasq/hostsfile"
+)
+
+// udpAddr waits for the server to listen and returns its UDP address.
+func udpAddr(t *testing.T, s *server) string {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		for _, srv := range s.dnsServers {
+			if srv.PacketConn != nil {
+				s.mu.Unlock()
+				return srv.PacketConn.LocalAddr().String()
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start listening")
+	return ""
+}
+
+func TestRunStop(t *testing.T) {
+	config := &Config{DnsAddr: "127.0.0.1:0", NoRec: true, RCacheTtl: 60, Ndots: 1}
+	CheckConfig(config)
+	hosts := testHostfile{"run.example.": {net.ParseIP("192.0.2.1")}}
+	s := New(hosts, config, "test")
+
+	// The server can be started again after it was stopped
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() { done <- s.Run() }()
+
+		req := new(dns.Msg)
+		req.SetQuestion("run.example.", dns.TypeA)
+		r, err := dns.Exchange(req, udpAddr(t, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 {
+			t.Fatalf("bad answer, got %v", r.Answer)
+		}
+
+		s.Stop()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("expected Run to return nil, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Run did not return after Stop")
+		}
+	}
+}
+
+func TestRunRestartPolling(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("192.0.2.1 poll.example\n")
+	f.Close()
+
+	hf, err := hosts.NewHostsfile(f.Name(), &hosts.Config{Poll: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{DnsAddr: "127.0.0.1:0", NoRec: true, RCacheTtl: 60, Ndots: 1}
+	CheckConfig(config)
+	s := New(hf, config, "test")
+
+	run := func() chan error {
+		done := make(chan error, 1)
+		go func() { done <- s.Run() }()
+		udpAddr(t, s)
+		return done
+	}
+	done := run()
+	s.Stop()
+	<-done
+
+	// Polling resumes when the server runs again after Stop
+	done = run()
+	defer func() { s.Stop(); <-done }()
+	if err := ioutil.WriteFile(f.Name(), []byte("192.0.2.2 poll.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("poll.example.", dns.TypeA)
+	for i := 0; i < 30; i++ {
+		r, err := dns.Exchange(req, udpAddr(t, s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) == 1 && r.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.2")) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("hostsfile was not polled after the server was restarted")
+}
+
+func TestRunListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	config := &Config{DnsAddr: l.Addr().String(), NoRec: true, RCacheTtl: 60, Ndots: 1}
+	CheckConfig(config)
+	s := New(testHostfile{}, config, "test")
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected error when address is in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
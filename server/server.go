@@ -6,10 +6,14 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -19,14 +23,35 @@ import (
 )
 
 type server struct {
-	hosts   Hostfile
-	config  *Config
+	hosts   atomic.Value // hostsHolder, replaced on reload
+	conf    atomic.Value // *Config, replaced on reload
+	confMu  sync.Mutex   // serializes replacing conf
 	version string
 
-	group        *sync.WaitGroup
-	dnsUDPclient *dns.Client // used for forwarding queries
-	dnsTCPclient *dns.Client // used for forwarding queries
-	rcache       *cache.Cache
+	group  *sync.WaitGroup
+	rcache *cache.Cache
+
+	mu          sync.Mutex
+	stop        chan struct{} // closed by Stop, nil if not running
+	errc        chan error    // listener errors
+	dnsServers  []*dns.Server
+	httpServers []*http.Server
+	qlog        *queryLog     // set while running, nil if the query log is disabled
+	dnstap      *dnstapOutput // set while running, nil if dnstap is disabled
+
+	upstreamMu sync.Mutex
+	upstreams  map[string]upstream // nameserver address -> upstream
+
+	healthMu sync.RWMutex
+	health   map[string]*upstreamHealth // nameserver address -> health state
+
+	rttMu     sync.RWMutex
+	srtt      map[string]time.Duration // nameserver address -> smoothed RTT
+	rttAt     map[string]time.Time     // nameserver address -> time of the last RTT update
+	rrCounter uint64                   // rotates nameservers with the round-robin strategy
+
+	refreshMu  sync.Mutex
+	refreshing map[string]*staleRefresh // cache key -> refresh of the stale response
 }
 
 type Hostfile interface {
@@ -34,34 +59,131 @@ type Hostfile interface {
 	FindReverse(name string) (string, error)
 }
 
+// hostsHolder wraps a Hostfile so that implementations of different types
+// can be stored in an atomic.Value.
+type hostsHolder struct {
+	Hostfile
+}
+
+// stopper is implemented by a Hostfile that polls for changes in the background.
+type stopper interface {
+	Stop()
+}
+
+// starter is implemented by a Hostfile that can resume polling after Stop.
+type starter interface {
+	Start()
+}
+
 // New returns a new server.
 func New(hostfile Hostfile, config *Config, v string) *server {
-	return &server{
-		hosts:   hostfile,
-		config:  config,
+	s := &server{
 		version: v,
 
-		group:        new(sync.WaitGroup),
-		rcache:       cache.New(config.RCache, config.RCacheTtl),
-		dnsUDPclient: &dns.Client{Net: "udp", ReadTimeout: 2 * config.ReadTimeout, WriteTimeout: 2 * config.ReadTimeout, SingleInflight: true},
-		dnsTCPclient: &dns.Client{Net: "tcp", ReadTimeout: 2 * config.ReadTimeout, WriteTimeout: 2 * config.ReadTimeout, SingleInflight: true},
+		group: new(sync.WaitGroup),
+		rcache: cache.New(config.RCache, cache.Config{
+			TTL:         config.RCacheTtl,
+			MinTTL:      config.MinCacheTtl,
+			MaxTTL:      config.MaxCacheTtl,
+			MaxNegTTL:   config.MaxNegCacheTtl,
+			ServFailTTL: config.ServfailCacheTtl,
+			StaleTTL:    config.StaleCacheTtl,
+			MaxBytes:    config.RCacheMaxSize << 20,
+			OnEvict:     func(reason string) { StatsCacheEvictionCount.Inc(1, reason) },
+		}),
+		upstreams:  make(map[string]upstream),
+		health:     make(map[string]*upstreamHealth),
+		srtt:       make(map[string]time.Duration),
+		rttAt:      make(map[string]time.Time),
+		refreshing: make(map[string]*staleRefresh),
 	}
+	s.hosts.Store(hostsHolder{hostfile})
+	s.conf.Store(config)
+	return s
+}
+
+// config returns the current configuration of the server.
+func (s *server) config() *Config {
+	return s.conf.Load().(*Config)
+}
+
+// hostfile returns the current hostsfile of the server.
+func (s *server) hostfile() Hostfile {
+	return s.hosts.Load().(hostsHolder).Hostfile
 }
 
 // Run is a blocking operation that starts the server listening on the DNS ports.
+// It returns when the server is stopped or one of the listeners fails. A stopped
+// server can be run again, polling of the hostsfile is resumed.
 func (s *server) Run() error {
 	mux := dns.NewServeMux()
 	mux.Handle(".", s)
 
+	s.mu.Lock()
+	if s.stop != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("Server is already running")
+	}
+	s.stop = make(chan struct{})
+	s.errc = make(chan error, 1)
+	stop, errc := s.stop, s.errc
+	qlog, err := openQueryLog(s.config())
+	if err != nil {
+		err = fmt.Errorf("Failed to open query log: %s", err)
+	} else {
+		s.qlog = qlog
+		s.dnstap, err = openDnstap(s.config(), s.version)
+		if err != nil {
+			err = fmt.Errorf("Failed to open dnstap output: %s", err)
+		} else {
+			err = s.listen(mux)
+		}
+	}
+	if h, ok := s.hostfile().(starter); ok && err == nil {
+		h.Start()
+	}
+	if err == nil && s.config().HealthCheckInterval > 0 {
+		s.group.Add(1)
+		go func() {
+			defer s.group.Done()
+			s.runHealthChecks(stop)
+		}()
+	}
+	s.mu.Unlock()
+
+	if err == nil {
+		select {
+		case <-stop:
+		case err = <-errc:
+		}
+	}
+
+	s.Stop()
+	// Stop might have been called concurrently, wait until it is done
+	s.group.Wait()
+	s.mu.Lock()
+	s.stop = nil
+	s.mu.Unlock()
+	return err
+}
+
+// listen starts all configured listeners. Must be called with s.mu held.
+func (s *server) listen(mux *dns.ServeMux) error {
 	dnsReadyMsg := func(addr, net string) {
 		rCacheState := "disabled"
-		if s.config.RCache > 0 {
-			rCacheState = fmt.Sprintf("capacity: %d", s.config.RCache)
+		if s.config().RCache > 0 {
+			rCacheState = fmt.Sprintf("capacity: %d", s.config().RCache)
+			if s.config().RCacheMaxSize > 0 {
+				rCacheState += fmt.Sprintf(", max size: %dMB", s.config().RCacheMaxSize)
+			}
+			if s.config().StaleCacheTtl > 0 {
+				rCacheState += fmt.Sprintf(", serving stale for: %ds", s.config().StaleCacheTtl)
+			}
 		}
 		log.Infof("Ready for queries on %s://%s [cache: %s]", net, addr, rCacheState)
 	}
 
-	if s.config.Systemd {
+	if s.config().Systemd {
 		packetConns, err := activation.PacketConns(false)
 		if err != nil {
 			return err
@@ -75,77 +197,246 @@ func (s *server) Run() error {
 		}
 		for _, p := range packetConns {
 			if u, ok := p.(*net.UDPConn); ok {
-				s.group.Add(1)
-				go func() {
-					defer s.group.Done()
-					if err := dns.ActivateAndServe(nil, u, mux); err != nil {
-						log.Fatalf("%s", err)
-					}
-				}()
+				if err := s.serveDNS(&dns.Server{PacketConn: u, Handler: mux}); err != nil {
+					return err
+				}
 				dnsReadyMsg(u.LocalAddr().String(), "udp")
 			}
 		}
 		for _, l := range listeners {
 			if t, ok := l.(*net.TCPListener); ok {
-				s.group.Add(1)
-				go func() {
-					defer s.group.Done()
-					if err := dns.ActivateAndServe(t, nil, mux); err != nil {
-						log.Fatalf("%s", err)
-					}
-				}()
+				if err := s.serveDNS(&dns.Server{Listener: t, Handler: mux}); err != nil {
+					return err
+				}
 				dnsReadyMsg(t.Addr().String(), "tcp")
 			}
 		}
 	} else {
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "tcp", mux); err != nil {
-				log.Fatalf("%s", err)
-			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "tcp")
-		s.group.Add(1)
-		go func() {
-			defer s.group.Done()
-			if err := dns.ListenAndServe(s.config.DnsAddr, "udp", mux); err != nil {
-				log.Fatalf("%s", err)
-			}
-		}()
-		dnsReadyMsg(s.config.DnsAddr, "udp")
+		l, err := net.Listen("tcp", s.config().DnsAddr)
+		if err != nil {
+			return err
+		}
+		if err := s.serveDNS(&dns.Server{Listener: l, Handler: mux}); err != nil {
+			return err
+		}
+		dnsReadyMsg(s.config().DnsAddr, "tcp")
+
+		p, err := net.ListenPacket("udp", s.config().DnsAddr)
+		if err != nil {
+			return err
+		}
+		if err := s.serveDNS(&dns.Server{PacketConn: p, Handler: mux}); err != nil {
+			return err
+		}
+		dnsReadyMsg(s.config().DnsAddr, "udp")
+	}
+
+	var tlsConfig *tls.Config
+	if s.config().TLSAddr != "" || s.config().DoHAddr != "" {
+		var err error
+		if tlsConfig, err = s.tlsConfig(); err != nil {
+			return fmt.Errorf("Failed to load TLS certificate: %s", err)
+		}
+	}
+
+	if s.config().TLSAddr != "" {
+		l, err := net.Listen("tcp", s.config().TLSAddr)
+		if err != nil {
+			return err
+		}
+		srv := &dns.Server{Listener: tls.NewListener(l, tlsConfig), Net: "tcp-tls", Handler: mux}
+		if err := s.serveDNS(srv); err != nil {
+			return err
+		}
+		dnsReadyMsg(s.config().TLSAddr, "tcp-tls")
+	}
+
+	if s.config().DoHAddr != "" {
+		l, err := net.Listen("tcp", s.config().DoHAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: s.dohMux(false), TLSConfig: tlsConfig}
+		s.serveHTTP(srv, func() error { return srv.ServeTLS(l, "", "") })
+		dnsReadyMsg(s.config().DoHAddr+dohPath, "https")
+	}
+
+	if s.config().DoHHTTPAddr != "" {
+		l, err := net.Listen("tcp", s.config().DoHHTTPAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: s.dohMux(true)}
+		s.serveHTTP(srv, func() error { return srv.Serve(l) })
+		dnsReadyMsg(s.config().DoHHTTPAddr+dohPath, "http")
+	}
+
+	if s.config().AdminAddr != "" {
+		l, err := net.Listen("tcp", s.config().AdminAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: s.adminMux()}
+		s.serveHTTP(srv, func() error { return srv.Serve(l) })
+		log.Infof("Serving admin API on http://%s", s.config().AdminAddr)
 	}
 
-	s.group.Wait()
 	return nil
 }
 
-// Stop stops a server.
+// serveDNS starts serving DNS on the listener or packet conn of srv and waits
+// until it is ready, so it can be shut down. Must be called with s.mu held.
+func (s *server) serveDNS(srv *dns.Server) error {
+	started := make(chan struct{})
+	failed := make(chan error, 1)
+	srv.NotifyStartedFunc = func() { close(started) }
+
+	s.group.Add(1)
+	go func() {
+		defer s.group.Done()
+		if err := srv.ActivateAndServe(); err != nil {
+			failed <- err
+			s.fail(err)
+		}
+	}()
+
+	select {
+	case <-started:
+	case err := <-failed:
+		return err
+	}
+	s.dnsServers = append(s.dnsServers, srv)
+	return nil
+}
+
+// serveHTTP runs serve in the background. Must be called with s.mu held.
+func (s *server) serveHTTP(srv *http.Server, serve func() error) {
+	s.httpServers = append(s.httpServers, srv)
+	s.group.Add(1)
+	go func() {
+		defer s.group.Done()
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			s.fail(err)
+		}
+	}()
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail makes Run return with err, unless the server is being stopped anyway.
+func (s *server) fail(err error) {
+	select {
+	case s.errc <- err:
+	default:
+	}
+}
+
+// Stop shuts down all listeners and waits up to ShutdownTimeout for queries
+// in flight to be answered and for stale responses being refreshed. It also
+// stops health checking and polling of the hostsfile. Run returns once the
+// server is stopped.
 func (s *server) Stop() {
-	// TODO(miek)
-	//s.group.Add(-2)
+	s.mu.Lock()
+	if s.stop == nil || isClosed(s.stop) {
+		s.mu.Unlock()
+		return
+	}
+	close(s.stop)
+	dnsServers, httpServers, qlog, dt := s.dnsServers, s.httpServers, s.qlog, s.dnstap
+	s.dnsServers, s.httpServers = nil, nil
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range dnsServers {
+		wg.Add(1)
+		go func(srv *dns.Server) {
+			defer wg.Done()
+			if err := srv.ShutdownContext(ctx); err != nil {
+				log.Warnf("Failed to shut down DNS listener: %s", err)
+			}
+		}(srv)
+	}
+	for _, srv := range httpServers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Warnf("Failed to shut down HTTP listener: %s", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	// Wait for health checks and cache refreshes before closing what they use
+	s.group.Wait()
+	s.closeUpstreams()
+	if h, ok := s.hostfile().(stopper); ok {
+		h.Stop()
+	}
+	if qlog != nil {
+		qlog.Close()
+	}
+	if dt != nil {
+		dt.Close()
+	}
+	log.Info("Server stopped")
 }
 
 // ServeDNS is the handler for DNS requests, responsible for parsing DNS request, possibly forwarding
 // it to a real dns server and returning a response.
 func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	startTime := time.Now()
+	proto := transport(w)
+	rw := &responseRecorder{ResponseWriter: w, source: sourceInternal}
+	w = rw
+	s.dnstap.clientQuery(w, req, proto, startTime)
 	defer func() {
 		elapsed := time.Since(startTime)
 		log.Debugf("[%d] Response time: %s", req.Id, elapsed)
+		if rw.msg != nil {
+			s.dnstap.clientResponse(w, req, rw.msg, proto, startTime)
+			StatsResponseCount.Inc(1, qtypeLabel(req.Question[0].Qtype), rcodeLabel(rw.msg.Rcode), proto)
+			StatsResponseTime.Observe(elapsed, proto)
+			observeAnswer(rw.msg, rw.source, proto)
+			if s.qlog != nil {
+				s.qlog.log(&queryRecord{
+					Time:         startTime,
+					Client:       w.RemoteAddr().String(),
+					Transport:    proto,
+					Name:         req.Question[0].Name,
+					Type:         qtypeLabel(req.Question[0].Qtype),
+					Rcode:        rcodeLabel(rw.msg.Rcode),
+					Answers:      len(rw.msg.Answer),
+					Source:       rw.source,
+					Upstream:     rw.trace.upstream,
+					SearchDomain: rw.trace.searchDomain,
+					Duration:     elapsed,
+				})
+			}
+		}
 	}()
 	m := new(dns.Msg)
 	m.SetReply(req)
 	m.Authoritative = false
 	m.RecursionAvailable = true
 	m.Compress = true
-	bufsize := uint16(512)
 	dnssec := false
-	tcp := false
 	local := true
 
 	q := req.Question[0]
 	name := strings.ToLower(q.Name)
+	tcp := isTCP(w)
+	bufsize := clientBufSize(req, tcp)
 
 	/*	if q.Qtype == dns.TypeANY {
 		m.Authoritative = false
@@ -160,15 +451,17 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}*/
 
 	if o := req.IsEdns0(); o != nil {
-		bufsize = o.UDPSize()
 		dnssec = o.Do()
-	}
-	if bufsize < 512 {
-		bufsize = 512
-	}
-	// with TCP we can send 64K
-	if tcp = isTCP(w); tcp {
-		bufsize = dns.MaxMsgSize - 1
+		// We only speak EDNS version 0
+		if o.Version() != 0 {
+			log.Debugf("[%d] Unsupported EDNS version %d", req.Id, o.Version())
+			m.SetRcode(req, dns.RcodeBadVers)
+			setEdns0(m, req, s.config().EdnsBufSize)
+			if err := w.WriteMsg(m); err != nil {
+				log.Errorf("Failed to return reply %q", err)
+			}
+			return
+		}
 	}
 
 	StatsRequestCount.Inc(1)
@@ -183,6 +476,8 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	m1 := s.rcache.Hit(q, dnssec, tcp, m.Id)
 	if m1 != nil {
 		log.Debugf("[%d] Found cached response for this query", req.Id)
+		setSource(w, sourceCache)
+		setEdns0(m1, req, s.config().EdnsBufSize)
 		if tcp {
 			if _, overflow := Fit(m1, dns.MaxMsgSize, tcp); overflow {
 				msgFail := new(dns.Msg)
@@ -192,7 +487,7 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 			}
 		} else {
 			// Overflow with udp always results in TC.
-			Fit(m1, int(bufsize), tcp)
+			Fit(m1, bufsize, tcp)
 		}
 		if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
 			s.RoundRobin(m1.Answer)
@@ -206,9 +501,13 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	StatsCacheMiss.Inc(1)
+	if dnssec {
+		StatsDnssecCacheMiss.Inc(1)
+	}
 
 	defer func() {
 		if local {
+			setEdns0(m, req, s.config().EdnsBufSize)
 			if m.Rcode == dns.RcodeServerFailure {
 				if err := w.WriteMsg(m); err != nil {
 					log.Errorf("Failed to return reply %q", err)
@@ -224,7 +523,7 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 					return
 				}
 			} else {
-				Fit(m, int(bufsize), tcp)
+				Fit(m, bufsize, tcp)
 			}
 			s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), m)
 
@@ -234,6 +533,19 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}()
 
+	// Names with static addresses are never looked up elsewhere
+	if ips, ok := s.staticAddresses(name); ok {
+		setSource(w, sourceStatic)
+		if len(ips) == 0 {
+			log.Debugf("[%d] Name is configured to not exist", req.Id)
+			m.SetRcode(req, dns.RcodeNameError)
+			return
+		}
+		log.Debugf("[%d] Found name in static addresses", req.Id)
+		m.Answer = ipRecords(q, ips, s.config().HostsTtl)
+		return
+	}
+
 	// Check hosts records before forwarding the query
 	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY {
 		records, err := s.AddressRecords(q, name)
@@ -242,11 +554,19 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		}
 		if len(records) > 0 {
 			log.Debugf("[%d] Found name in hostsfile records", req.Id)
+			setSource(w, sourceHosts)
 			m.Answer = append(m.Answer, records...)
 			return
 		}
 	}
 
+	if s.isLocalDomain(name) {
+		log.Debugf("[%d] Not forwarding query for local domain", req.Id)
+		setSource(w, sourceStatic)
+		m.SetRcode(req, dns.RcodeNameError)
+		return
+	}
+
 	if q.Qtype == dns.TypePTR && strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
 		local = false
 		resp := s.ServeDNSReverse(w, req)
@@ -257,6 +577,7 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	if q.Qclass == dns.ClassCHAOS {
+		setSource(w, sourceChaos)
 		m.Authoritative = true
 		if q.Qtype == dns.TypeTXT {
 			switch name {
@@ -283,6 +604,10 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	// Forward all other queries
 	local = false
+	if stale := s.rcache.Stale(q, dnssec, tcp, m.Id); stale != nil {
+		s.serveStale(w, req, cache.Key(q, dnssec, tcp), stale)
+		return
+	}
 	resp := s.ServeDNSForward(w, req)
 	if resp != nil {
 		s.rcache.InsertMessage(cache.Key(q, dnssec, tcp), resp)
@@ -291,40 +616,44 @@ func (s *server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 }
 
 func (s *server) AddressRecords(q dns.Question, name string) (records []dns.RR, err error) {
-	results, err := s.hosts.FindHosts(name)
+	results, err := s.hostfile().FindHosts(name)
 	if err != nil {
 		return nil, err
 	}
+	return ipRecords(q, results, s.config().HostsTtl), nil
+}
 
-	for _, ip := range results {
+// ipRecords returns the A/AAAA records for the addresses matching the question type.
+func ipRecords(q dns.Question, ips []net.IP, ttl uint32) (records []dns.RR) {
+	for _, ip := range ips {
 		switch {
 		case ip.To4() != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
 			r := new(dns.A)
 			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA,
-				Class: dns.ClassINET, Ttl: s.config.HostsTtl}
+				Class: dns.ClassINET, Ttl: ttl}
 			r.A = ip.To4()
 			records = append(records, r)
 		case ip.To4() == nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
 			r := new(dns.AAAA)
 			r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA,
-				Class: dns.ClassINET, Ttl: s.config.HostsTtl}
+				Class: dns.ClassINET, Ttl: ttl}
 			r.AAAA = ip.To16()
 			records = append(records, r)
 		}
 	}
-	return records, nil
+	return records
 }
 
 func (s *server) PTRRecords(q dns.Question) (records []dns.RR, err error) {
 	name := strings.ToLower(q.Name)
-	result, err := s.hosts.FindReverse(name)
+	result, err := s.hostfile().FindReverse(name)
 	if err != nil {
 		return nil, err
 	}
 	if result != "" {
 		r := new(dns.PTR)
 		r.Hdr = dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR,
-			Class: dns.ClassINET, Ttl: s.config.HostsTtl}
+			Class: dns.ClassINET, Ttl: s.config().HostsTtl}
 		r.Ptr = result
 		records = append(records, r)
 	}
@@ -336,7 +665,7 @@ func (s *server) ServerFailure(m, req *dns.Msg) {
 }
 
 func (s *server) RoundRobin(rrs []dns.RR) {
-	if !s.config.RoundRobin {
+	if !s.config().RoundRobin {
 		return
 	}
 	// If we have more than 1 CNAME don't touch the packet, because some stub resolver (=glibc)
@@ -0,0 +1,107 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// refreshWriter implements dns.ResponseWriter for queries resolved to refresh
+// a stale response. It has the addresses of the client, so the query is
+// forwarded over the same transport, but doesn't write to the client.
+type refreshWriter struct {
+	dohResponseWriter
+}
+
+// staleRefresh is a query forwarded to refresh a stale response. The fields
+// are set before done is closed.
+type staleRefresh struct {
+	done   chan struct{}
+	resp   *dns.Msg
+	source string
+	trace  trace
+}
+
+// serveStale forwards the query while holding on to the expired response
+// stale (RFC 8767). The client gets stale if resolving fails or takes longer
+// than StaleAnswerTimeout, in which case the query is resolved in the
+// background to refresh the cache. Only one query per key is forwarded at a
+// time, other clients asking meanwhile wait for its response.
+func (s *server) serveStale(w dns.ResponseWriter, req *dns.Msg, key string, stale *dns.Msg) {
+	r, forward := s.startRefresh(key)
+	var rec *responseRecorder
+	if forward && !s.track() {
+		// Stop doesn't wait for a refresh started while stopping
+		s.endRefresh(key)
+		close(r.done)
+	} else if forward {
+		// The refresh may outlive the handler, so it must not use w
+		rec = &responseRecorder{ResponseWriter: &refreshWriter{dohResponseWriter{
+			localAddr:  w.LocalAddr(),
+			remoteAddr: w.RemoteAddr(),
+		}}}
+		go func() {
+			defer s.group.Done()
+			resp := s.ServeDNSForward(rec, req)
+			// Keep the stale response rather than replacing it by a failure
+			if resp != nil && resp.Rcode != dns.RcodeServerFailure {
+				s.rcache.InsertMessage(key, resp)
+			}
+			r.resp, r.source, r.trace = resp, rec.source, rec.trace
+			s.endRefresh(key)
+			close(r.done)
+		}()
+	}
+
+	var timeout <-chan time.Time
+	if d := s.config().StaleAnswerTimeout; d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-r.done:
+		if r.resp != nil && r.resp.Rcode != dns.RcodeServerFailure {
+			setSource(w, r.source)
+			setTrace(w, r.trace)
+			if rec != nil && rec.msg != nil {
+				writeMsg(w, rec.msg)
+				return
+			}
+			m := r.resp.Copy()
+			m.Id = req.Id
+			writeFit(w, req, m, s.config().EdnsBufSize)
+			return
+		}
+		log.Debugf("[%d] Failed to resolve query, answering with stale response", req.Id)
+	case <-timeout:
+		log.Debugf("[%d] Resolving query takes too long, answering with stale response", req.Id)
+	}
+	setSource(w, sourceStale)
+	writeFit(w, req, stale, s.config().EdnsBufSize)
+}
+
+// startRefresh returns the refresh of the response for key in progress, or
+// a new one and true if the query has to be forwarded.
+func (s *server) startRefresh(key string) (*staleRefresh, bool) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	if r, ok := s.refreshing[key]; ok {
+		return r, false
+	}
+	r := &staleRefresh{done: make(chan struct{})}
+	s.refreshing[key] = r
+	return r, true
+}
+
+func (s *server) endRefresh(key string) {
+	s.refreshMu.Lock()
+	delete(s.refreshing, key)
+	s.refreshMu.Unlock()
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/janeczku/go-dnsmasq/cache"
+)
+
+const (
+	upstreamAnswer = iota
+	upstreamFail
+	upstreamSlow
+)
+
+func TestServeStale(t *testing.T) {
+	var mode int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		switch atomic.LoadInt32(&mode) {
+		case upstreamAnswer:
+			m.Answer = []dns.RR{newA("stale.example. 1 IN A 192.0.2.1")}
+		case upstreamFail:
+			m.Rcode = dns.RcodeServerFailure
+		case upstreamSlow:
+			time.Sleep(200 * time.Millisecond)
+			m.Answer = []dns.RR{newA("stale.example. 60 IN A 192.0.2.2")}
+		}
+		w.WriteMsg(m)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen on udp: %v", err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: handler}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+
+	answers := new(testVec)
+	StatsAnswerCount = answers
+	defer func() { StatsAnswerCount = nopVec{} }()
+
+	config := &Config{
+		DnsAddr:       "127.0.0.1:0",
+		Nameservers:   []string{pc.LocalAddr().String()},
+		RCache:        10,
+		RCacheTtl:     60,
+		StaleCacheTtl: 60,
+		Ndots:         1,
+	}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(testHostfile{}, config, "test")
+
+	query := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("stale.example.", dns.TypeA)
+		w := new(testWriter)
+		s.ServeDNS(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("expected an answer, got %v", w.msg)
+		}
+		return w.msg
+	}
+
+	query()
+	time.Sleep(1100 * time.Millisecond)
+
+	// The expired answer is kept and returned while the upstream fails
+	atomic.StoreInt32(&mode, upstreamFail)
+	if m := query(); m.Answer[0].Header().Ttl != cache.StaleAnswerTTL || m.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("expected the stale answer, got %v", m)
+	}
+
+	// Without a timeout the client waits for the upstream
+	atomic.StoreInt32(&mode, upstreamSlow)
+	if m := query(); m.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("expected the fresh answer, got %v", m)
+	}
+
+	s.rcache.Flush()
+	atomic.StoreInt32(&mode, upstreamAnswer)
+	query()
+	time.Sleep(1100 * time.Millisecond)
+
+	// With a timeout the client gets the stale answer and the cache is
+	// refreshed in the background
+	s.config().StaleAnswerTimeout = 50 * time.Millisecond
+	atomic.StoreInt32(&mode, upstreamSlow)
+	if m := query(); m.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("expected the stale answer, got %v", m)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if m := s.rcache.Hit(dns.Question{Name: "stale.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, false, 1); m == nil ||
+		m.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("expected the refreshed answer in the cache, got %v", m)
+	}
+
+	expected := "NOERROR,upstream,udp NOERROR,stale,udp NOERROR,upstream,udp NOERROR,upstream,udp NOERROR,stale,udp"
+	if got := strings.Join(answers.labels, " "); got != expected {
+		t.Fatalf("expected answers %s, got %s", expected, got)
+	}
+}
+
+// returnedWriter fails the test if it is used after the handler returned.
+type returnedWriter struct {
+	testWriter
+	t        *testing.T
+	returned int32
+}
+
+func (w *returnedWriter) check() {
+	if atomic.LoadInt32(&w.returned) == 1 {
+		w.t.Error("response writer used after the handler returned")
+	}
+}
+
+func (w *returnedWriter) LocalAddr() net.Addr       { w.check(); return w.testWriter.LocalAddr() }
+func (w *returnedWriter) RemoteAddr() net.Addr      { w.check(); return w.testWriter.RemoteAddr() }
+func (w *returnedWriter) WriteMsg(m *dns.Msg) error { w.check(); return w.testWriter.WriteMsg(m) }
+
+// countingUpstream answers queries after delay and counts them.
+type countingUpstream struct {
+	queries  int32
+	answered int32
+	delay    int64 // time.Duration
+}
+
+func (u *countingUpstream) Exchange(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, time.Duration, error) {
+	n := atomic.AddInt32(&u.queries, 1)
+	select {
+	case <-time.After(time.Duration(atomic.LoadInt64(&u.delay))):
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Answer = []dns.RR{newA(fmt.Sprintf("refresh.example. 1 IN A 192.0.2.%d", n))}
+	atomic.AddInt32(&u.answered, 1)
+	return m, 0, nil
+}
+
+func (u *countingUpstream) Close()         {}
+func (u *countingUpstream) String() string { return "counting" }
+
+func TestServeStaleRefreshOnce(t *testing.T) {
+	config := &Config{
+		DnsAddr:            "127.0.0.1:0",
+		Nameservers:        []string{"192.0.2.53:53"},
+		RCache:             10,
+		RCacheTtl:          60,
+		StaleCacheTtl:      60,
+		StaleAnswerTimeout: 50 * time.Millisecond,
+		Ndots:              1,
+	}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(testHostfile{}, config, "test")
+	u := new(countingUpstream)
+	s.upstreams["192.0.2.53:53"] = u
+
+	// queries asks n clients concurrently and returns the addresses answered
+	queries := func(n int) []string {
+		var wg sync.WaitGroup
+		addrs := make([]string, n)
+		for i := range addrs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				req := new(dns.Msg)
+				req.SetQuestion("refresh.example.", dns.TypeA)
+				w := &returnedWriter{t: t}
+				s.ServeDNS(w, req)
+				atomic.StoreInt32(&w.returned, 1)
+				if w.msg == nil || w.msg.Id != req.Id || len(w.msg.Answer) != 1 {
+					t.Errorf("expected an answer, got %v", w.msg)
+					return
+				}
+				addrs[i] = w.msg.Answer[0].(*dns.A).A.String()
+			}(i)
+		}
+		wg.Wait()
+		return addrs
+	}
+
+	queries(1)
+	time.Sleep(1100 * time.Millisecond)
+
+	// While the expired response is refreshed in the background the query
+	// isn't forwarded again, and the client writer isn't used by the refresh
+	atomic.StoreInt64(&u.delay, int64(200*time.Millisecond))
+	for _, addr := range queries(5) {
+		if addr != "192.0.2.1" {
+			t.Fatalf("expected the stale answer, got %s", addr)
+		}
+	}
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&u.queries); n != 2 {
+		t.Fatalf("expected 2 queries to the upstream, got %d", n)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	// Without a timeout the clients wait for the same query
+	s.config().StaleAnswerTimeout = 0
+	for _, addr := range queries(5) {
+		if addr != "192.0.2.3" {
+			t.Fatalf("expected the fresh answer, got %s", addr)
+		}
+	}
+	if n := atomic.LoadInt32(&u.queries); n != 3 {
+		t.Fatalf("expected 3 queries to the upstream, got %d", n)
+	}
+}
+
+func TestServeStaleStop(t *testing.T) {
+	config := &Config{
+		DnsAddr:            "127.0.0.1:0",
+		Nameservers:        []string{"192.0.2.53:53"},
+		RCache:             10,
+		RCacheTtl:          60,
+		StaleCacheTtl:      60,
+		StaleAnswerTimeout: 50 * time.Millisecond,
+		Ndots:              1,
+	}
+	if err := CheckConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	s := New(testHostfile{}, config, "test")
+	u := new(countingUpstream)
+	s.upstreams["192.0.2.53:53"] = u
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	udpAddr(t, s)
+
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion("refresh.example.", dns.TypeA)
+		s.ServeDNS(new(testWriter), req)
+	}
+	query()
+	time.Sleep(1100 * time.Millisecond)
+
+	// Stop waits for the refresh in the background
+	atomic.StoreInt64(&u.delay, int64(200*time.Millisecond))
+	query()
+	s.Stop()
+	<-done
+	if n := atomic.LoadInt32(&u.answered); n != 2 {
+		t.Fatalf("expected the refresh to be done when stopped, got %d answers", n)
+	}
+}
@@ -4,18 +4,48 @@
 
 package server
 
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
 // Counter is the metric interface used by this package
 type Counter interface {
 	Inc(i int64)
 }
 
+// CounterVec is a counter partitioned by label values
+type CounterVec interface {
+	Inc(i int64, labels ...string)
+}
+
+// HistogramVec records the distribution of durations partitioned by label values
+type HistogramVec interface {
+	Observe(d time.Duration, labels ...string)
+}
+
+// GaugeVec is a value that can go up and down, partitioned by label values
+type GaugeVec interface {
+	Set(v float64, labels ...string)
+}
+
 type nopCounter struct{}
 
 func (nopCounter) Inc(_ int64) {}
 
+type nopVec struct{}
+
+func (nopVec) Inc(_ int64, _ ...string)             {}
+func (nopVec) Observe(_ time.Duration, _ ...string) {}
+func (nopVec) Set(_ float64, _ ...string)           {}
+
 var (
 	StatsForwardCount     Counter = nopCounter{}
 	StatsStubForwardCount Counter = nopCounter{}
+	StatsTCPFallbackCount Counter = nopCounter{}
 	StatsLookupCount      Counter = nopCounter{}
 	StatsRequestCount     Counter = nopCounter{}
 	StatsDnssecOkCount    Counter = nopCounter{}
@@ -26,4 +56,140 @@ var (
 
 	StatsCacheMiss Counter = nopCounter{}
 	StatsCacheHit  Counter = nopCounter{}
+	// Labels: reason ("capacity" or "expired")
+	StatsCacheEvictionCount CounterVec = nopVec{}
+
+	StatsUpstreamProbeFailCount Counter = nopCounter{}
+	StatsUpstreamDownCount      Counter = nopCounter{}
+	StatsUpstreamUpCount        Counter = nopCounter{}
+
+	// Labels: qtype, rcode, transport
+	StatsResponseCount CounterVec = nopVec{}
+	// Labels: transport
+	StatsResponseTime HistogramVec = nopVec{}
+	// Labels: outcome, source, transport
+	StatsAnswerCount CounterVec = nopVec{}
+
+	// Labels: upstream
+	StatsUpstreamQueryCount CounterVec = nopVec{}
+	// Labels: upstream, rcode
+	StatsUpstreamResponseCount CounterVec = nopVec{}
+	// Labels: upstream, reason ("timeout" or "error")
+	StatsUpstreamErrorCount CounterVec = nopVec{}
+	// Labels: upstream
+	StatsUpstreamResponseTime HistogramVec = nopVec{}
+	// Smoothed response time in seconds. Labels: upstream
+	StatsUpstreamRTT GaugeVec = nopVec{}
+	// 1 if the upstream is up, 0 if health checking marked it down. Labels: upstream
+	StatsUpstreamHealthy GaugeVec = nopVec{}
 )
+
+// Sources of the responses to clients.
+const (
+	sourceInternal = "internal" // errors and refusals of this server
+	sourceCache    = "cache"
+	sourceStale    = "stale"  // expired responses from the cache
+	sourceHosts    = "hosts"  // hostsfiles
+	sourceStatic   = "static" // Addresses, LocalDomains and BogusPriv
+	sourceUpstream = "upstream"
+	sourceStub     = "stub"
+	sourceChaos    = "chaos"
+)
+
+// outcome classifies a response as NOERROR, NODATA, NXDOMAIN, SERVFAIL,
+// REFUSED or one of the other response codes.
+func outcome(m *dns.Msg) string {
+	if m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0 {
+		return "NODATA"
+	}
+	return rcodeLabel(m.Rcode)
+}
+
+// observeAnswer counts the response sent to the client.
+func observeAnswer(m *dns.Msg, source, proto string) {
+	result := outcome(m)
+	switch result {
+	case "NODATA":
+		StatsNoDataCount.Inc(1)
+	case "NXDOMAIN":
+		StatsNameErrorCount.Inc(1)
+	}
+	switch source {
+	case sourceHosts, sourceStatic, sourceChaos:
+		StatsLookupCount.Inc(1)
+	}
+	StatsAnswerCount.Inc(1, result, source, proto)
+}
+
+// setSource records where the response written to w comes from.
+func setSource(w dns.ResponseWriter, source string) {
+	if rw, ok := w.(*responseRecorder); ok {
+		rw.source = source
+	}
+}
+
+// setTrace records the forwarding details of the response written to w.
+func setTrace(w dns.ResponseWriter, t trace) {
+	if rw, ok := w.(*responseRecorder); ok {
+		rw.trace = t
+	}
+}
+
+// qtypeLabel returns the label value for a query type. Types without a name
+// share one value to limit the number of label values.
+func qtypeLabel(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "other"
+}
+
+// rcodeLabel returns the label value for a response code.
+func rcodeLabel(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return "other"
+}
+
+// isTimeout returns true if err is caused by a nameserver not answering in time.
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded || err == errUpstreamTimeout {
+		return true
+	}
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// transport returns the name of the transport a query was received on.
+func transport(w dns.ResponseWriter) string {
+	switch w := w.(type) {
+	case *dohResponseWriter:
+		if w.secure {
+			return "https"
+		}
+		return "http"
+	case dns.ConnectionStater:
+		if w.ConnectionState() != nil {
+			return "tls"
+		}
+	}
+	if isTCP(w) {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// responseRecorder keeps the last message written to the client and where
+// it comes from.
+type responseRecorder struct {
+	dns.ResponseWriter
+	msg    *dns.Msg
+	source string
+	trace  trace
+}
+
+func (w *responseRecorder) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
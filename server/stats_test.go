@@ -0,0 +1,121 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testVec records the label values it was called with.
+type testVec struct {
+	mu     sync.Mutex
+	labels []string
+}
+
+func (v *testVec) Inc(_ int64, labels ...string) { v.record(labels) }
+
+func (v *testVec) Observe(_ time.Duration, labels ...string) { v.record(labels) }
+
+func (v *testVec) Set(_ float64, labels ...string) { v.record(labels) }
+
+func (v *testVec) record(labels []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.labels = append(v.labels, strings.Join(labels, ","))
+}
+
+func TestResponseStats(t *testing.T) {
+	responses, responseTime, answers := new(testVec), new(testVec), new(testVec)
+	StatsResponseCount, StatsResponseTime, StatsAnswerCount = responses, responseTime, answers
+	defer func() { StatsResponseCount, StatsResponseTime, StatsAnswerCount = nopVec{}, nopVec{}, nopVec{} }()
+
+	config := &Config{
+		DnsAddr:      "127.0.0.1:0",
+		RCacheTtl:    60,
+		RCache:       10,
+		Ndots:        1,
+		Nameservers:  []string{"127.0.0.1:1"},
+		Addresses:    map[string][]string{"static.example.": {"192.0.2.2"}},
+		LocalDomains: []string{"lan."},
+	}
+	CheckConfig(config)
+	hosts := testHostfile{"stats.example.": {net.ParseIP("192.0.2.1")}}
+	s := New(hosts, config, "test")
+
+	queries := []struct {
+		name  string
+		qtype uint16
+		class uint16
+	}{
+		{"stats.example.", dns.TypeA, dns.ClassINET},
+		{"stats.example.", dns.TypeA, dns.ClassINET},
+		{"stats.example.", 65000, dns.ClassINET},
+		{"static.example.", dns.TypeAAAA, dns.ClassINET},
+		{"printer.lan.", dns.TypeA, dns.ClassINET},
+		{"version.bind.", dns.TypeTXT, dns.ClassCHAOS},
+	}
+	for _, q := range queries {
+		req := new(dns.Msg)
+		req.SetQuestion(q.name, q.qtype)
+		req.Question[0].Qclass = q.class
+		s.ServeDNS(new(testWriter), req)
+	}
+
+	expectedResponses := []string{"A,NOERROR,udp", "A,NOERROR,udp", "other,SERVFAIL,udp",
+		"AAAA,NOERROR,udp", "A,NXDOMAIN,udp", "TXT,NOERROR,udp"}
+	if strings.Join(responses.labels, " ") != strings.Join(expectedResponses, " ") {
+		t.Fatalf("expected responses %v, got %v", expectedResponses, responses.labels)
+	}
+	expectedAnswers := []string{"NOERROR,hosts,udp", "NOERROR,cache,udp", "SERVFAIL,upstream,udp",
+		"NODATA,static,udp", "NXDOMAIN,static,udp", "NOERROR,chaos,udp"}
+	if strings.Join(answers.labels, " ") != strings.Join(expectedAnswers, " ") {
+		t.Fatalf("expected answers %v, got %v", expectedAnswers, answers.labels)
+	}
+	if len(responseTime.labels) != len(queries) || responseTime.labels[0] != "udp" {
+		t.Fatalf("expected udp response times, got %v", responseTime.labels)
+	}
+}
+
+func TestUpstreamStats(t *testing.T) {
+	queries, responses, failures, rtt := new(testVec), new(testVec), new(testVec), new(testVec)
+	StatsUpstreamQueryCount, StatsUpstreamResponseCount, StatsUpstreamErrorCount, StatsUpstreamRTT =
+		queries, responses, failures, rtt
+	defer func() {
+		StatsUpstreamQueryCount, StatsUpstreamResponseCount, StatsUpstreamErrorCount, StatsUpstreamRTT =
+			nopVec{}, nopVec{}, nopVec{}, nopVec{}
+	}()
+
+	r := new(dns.Msg)
+	r.Rcode = dns.RcodeServerFailure
+	observeUpstream("192.0.2.1:53", r, time.Millisecond, nil)
+	observeUpstream("192.0.2.1:53", nil, 0, context.DeadlineExceeded)
+	observeUpstream("192.0.2.2:53", nil, 0, &net.OpError{Op: "read", Err: errors.New("connection refused")})
+
+	s := newTestStrategyServer()
+	s.updateRTT("192.0.2.1:53", time.Millisecond, nil)
+
+	testcases := []struct {
+		vec      *testVec
+		expected string
+	}{
+		{queries, "192.0.2.1:53 192.0.2.1:53 192.0.2.2:53"},
+		{responses, "192.0.2.1:53,SERVFAIL"},
+		{failures, "192.0.2.1:53,timeout 192.0.2.2:53,error"},
+		{rtt, "192.0.2.1:53"},
+	}
+	for i, tc := range testcases {
+		if labels := strings.Join(tc.vec.labels, " "); labels != tc.expected {
+			t.Errorf("%d: expected %q, got %q", i, tc.expected, labels)
+		}
+	}
+}
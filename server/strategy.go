@@ -0,0 +1,212 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// How long it takes for the smoothed RTT of a nameserver that isn't queried
+// to be halved. Nameservers that were slow or failed are tried again with the
+// fastest strategy once their RTT decayed below that of the others.
+const rttDecayInterval = 10 * time.Second
+
+// Upstream selection strategies
+const (
+	// Query the nameservers in the configured order (glibc style)
+	StrategySequential = "sequential"
+	// Rotate the first nameserver to query for every request
+	StrategyRoundRobin = "round-robin"
+	// Query the nameservers in random order
+	StrategyRandom = "random"
+	// Query the nameserver with the lowest smoothed RTT first
+	StrategyFastest = "fastest"
+	// Query all nameservers at once and use the first good answer
+	StrategyParallel = "parallel"
+)
+
+// ValidStrategy returns true if name is a known upstream selection strategy.
+func ValidStrategy(name string) bool {
+	switch name {
+	case StrategySequential, StrategyRoundRobin, StrategyRandom, StrategyFastest, StrategyParallel:
+		return true
+	}
+	return false
+}
+
+// orderUpstreams returns the nameservers in the order they should be queried.
+func (s *server) orderUpstreams(nservers []string, strategy string) []string {
+	if len(nservers) < 2 {
+		return nservers
+	}
+
+	ordered := make([]string, len(nservers))
+	switch strategy {
+	case StrategyRoundRobin:
+		start := int(atomic.AddUint64(&s.rrCounter, 1) % uint64(len(nservers)))
+		copy(ordered, nservers[start:])
+		copy(ordered[len(nservers)-start:], nservers[:start])
+	case StrategyRandom:
+		for i, j := range rand.Perm(len(nservers)) {
+			ordered[i] = nservers[j]
+		}
+	case StrategyFastest:
+		copy(ordered, nservers)
+		now := time.Now()
+		s.rttMu.RLock()
+		sort.SliceStable(ordered, func(i, j int) bool {
+			// Nameservers without measurements sort first, so they get probed
+			return s.decayedRTT(ordered[i], now) < s.decayedRTT(ordered[j], now)
+		})
+		s.rttMu.RUnlock()
+	default:
+		copy(ordered, nservers)
+	}
+	return ordered
+}
+
+// updateRTT records the response time of a nameserver as an exponentially
+// weighted moving average. Failed queries count as a full timeout.
+func (s *server) updateRTT(addr string, rtt time.Duration, err error) {
+	if err != nil {
+		rtt = s.config().FwdTimeout
+	}
+	now := time.Now()
+	s.rttMu.Lock()
+	defer s.rttMu.Unlock()
+	if _, ok := s.srtt[addr]; ok {
+		s.srtt[addr] = (7*s.decayedRTT(addr, now) + rtt) / 8
+	} else {
+		s.srtt[addr] = rtt
+	}
+	s.rttAt[addr] = now
+	StatsUpstreamRTT.Set(s.srtt[addr].Seconds(), addr)
+}
+
+// decayedRTT returns the smoothed RTT of a nameserver halved for every
+// rttDecayInterval since it was last updated. Must be called with rttMu held.
+func (s *server) decayedRTT(addr string, now time.Time) time.Duration {
+	srtt := s.srtt[addr]
+	if n := now.Sub(s.rttAt[addr]) / rttDecayInterval; n >= 63 {
+		return 0
+	} else if n > 0 {
+		srtt >>= uint(n)
+	}
+	return srtt
+}
+
+// exchange sends the query to the nameserver and keeps track of its RTT.
+// The attempt is limited to FwdTimeout and the deadline of ctx.
+func (s *server) exchange(ctx context.Context, addr string, req *dns.Msg, tcp bool) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errDeadline
+	}
+	u, err := s.upstream(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.config().FwdTimeout)
+	defer cancel()
+	r, rtt, err := s.exchangeUpstream(ctx, u, addr, req, tcp)
+	s.updateRTT(addr, rtt, err)
+	observeUpstream(addr, r, rtt, err)
+
+	// Retry truncated UDP responses over TCP to get the full answer
+	if _, plain := u.(*plainUpstream); plain && err == nil && r.Truncated && !tcp && !s.config().NoTCPFallback {
+		log.Debugf("[%d] Truncated response from upstream %s, retrying over TCP", req.Id, addr)
+		StatsTCPFallbackCount.Inc(1)
+		r1, rtt1, err1 := s.exchangeUpstream(ctx, u, addr, req, true)
+		observeUpstream(addr, r1, rtt1, err1)
+		if err1 != nil {
+			log.Debugf("[%d] Failed to query upstream %s over TCP: %v", req.Id, addr, err1)
+			return r, nil
+		}
+		return r1, nil
+	}
+	return r, err
+}
+
+// exchangeUpstream sends req to the nameserver addr and taps the query and
+// the response.
+func (s *server) exchangeUpstream(ctx context.Context, u upstream, addr string, req *dns.Msg, tcp bool) (*dns.Msg, time.Duration, error) {
+	queryTime := time.Now()
+	s.dnstap.forwarderQuery(addr, req, tcp, queryTime)
+	r, rtt, err := u.Exchange(ctx, req, tcp)
+	if err == nil {
+		s.dnstap.forwarderResponse(addr, req, r, tcp, queryTime)
+	}
+	return r, rtt, err
+}
+
+// observeUpstream records the outcome of a query to a nameserver in the
+// upstream stats.
+func observeUpstream(addr string, r *dns.Msg, rtt time.Duration, err error) {
+	StatsUpstreamQueryCount.Inc(1, addr)
+	if err != nil {
+		reason := "error"
+		if isTimeout(err) {
+			reason = "timeout"
+		}
+		StatsUpstreamErrorCount.Inc(1, addr, reason)
+		return
+	}
+	StatsUpstreamResponseCount.Inc(1, addr, rcodeLabel(r.Rcode))
+	StatsUpstreamResponseTime.Observe(rtt, addr)
+}
+
+// forwardParallel sends the query to all nameservers at once and returns the first
+// good answer. If none of them gives one the last answer or error is returned.
+func (s *server) forwardParallel(ctx context.Context, req *dns.Msg, tcp bool, nservers []string) (*dns.Msg, error) {
+	type result struct {
+		addr string
+		r    *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(nservers))
+	for _, addr := range nservers {
+		log.Debugf("[%d] Querying upstream %s for qname '%s'", req.Id, addr, req.Question[0].Name)
+		go func(addr string) {
+			r, err := s.exchange(ctx, addr, req, tcp)
+			results <- result{addr, r, err}
+		}(addr)
+	}
+
+	var res result
+	for range nservers {
+		res = <-results
+		if res.err != nil {
+			log.Debugf("[%d] Failed to query upstream %s for qname '%s': %v",
+				req.Id, res.addr, req.Question[0].Name, res.err)
+			continue
+		}
+		log.Debugf("[%d] Response code from upstream %s: %s", req.Id, res.addr, dns.RcodeToString[res.r.Rcode])
+		traceFrom(ctx).upstream = res.addr
+		if finalRcode(res.r.Rcode) {
+			return res.r, nil
+		}
+	}
+	return res.r, res.err
+}
+
+// finalRcode returns true if a response with this rcode should be returned
+// to the client instead of trying the next nameserver.
+func finalRcode(rcode int) bool {
+	switch rcode {
+	// SUCCESS
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return true
+	// NO RECOVERY
+	case dns.RcodeFormatError, dns.RcodeRefused, dns.RcodeNotImplemented:
+		return true
+	}
+	return false
+}
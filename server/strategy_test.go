@@ -0,0 +1,192 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestStrategyServer() *server {
+	config := &Config{DnsAddr: "127.0.0.1:0", NoRec: true, RCacheTtl: 60, Ndots: 1, ReadTimeout: time.Second}
+	CheckConfig(config)
+	return New(testHostfile{}, config, "test")
+}
+
+func TestOrderUpstreamsRoundRobin(t *testing.T) {
+	s := newTestStrategyServer()
+	nservers := []string{"a", "b", "c"}
+
+	first := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		ordered := s.orderUpstreams(nservers, StrategyRoundRobin)
+		if len(ordered) != len(nservers) {
+			t.Fatalf("bad length, expected %d, got %d", len(nservers), len(ordered))
+		}
+		first[ordered[0]]++
+	}
+	for _, ns := range nservers {
+		if first[ns] != 2 {
+			t.Fatalf("expected every nameserver to be queried first twice, got %v", first)
+		}
+	}
+	if !reflect.DeepEqual(nservers, []string{"a", "b", "c"}) {
+		t.Fatalf("configured nameservers were modified: %v", nservers)
+	}
+}
+
+func TestOrderUpstreamsFastest(t *testing.T) {
+	s := newTestStrategyServer()
+	nservers := []string{"a", "b", "c"}
+
+	s.updateRTT("a", 30*time.Millisecond, nil)
+	s.updateRTT("b", 10*time.Millisecond, nil)
+	s.updateRTT("c", 0, errors.New("timeout"))
+
+	expected := []string{"b", "a", "c"}
+	if ordered := s.orderUpstreams(nservers, StrategyFastest); !reflect.DeepEqual(ordered, expected) {
+		t.Fatalf("bad order, expected %v, got %v", expected, ordered)
+	}
+
+	// Smoothing: a single slow response does not outweigh the history
+	s.updateRTT("b", 50*time.Millisecond, nil)
+	if ordered := s.orderUpstreams(nservers, StrategyFastest); !reflect.DeepEqual(ordered, expected) {
+		t.Fatalf("bad order, expected %v, got %v", expected, ordered)
+	}
+}
+
+func TestOrderUpstreamsFastestRecovers(t *testing.T) {
+	s := newTestStrategyServer()
+	nservers := []string{"a", "b"}
+
+	s.updateRTT("a", 10*time.Millisecond, nil)
+	s.updateRTT("b", 30*time.Millisecond, nil)
+	if ordered := s.orderUpstreams(nservers, StrategyFastest); ordered[0] != "a" {
+		t.Fatalf("expected a to be queried first, got %v", ordered)
+	}
+
+	// A single timeout of the fastest nameserver puts it last
+	s.updateRTT("a", 0, errors.New("timeout"))
+	if ordered := s.orderUpstreams(nservers, StrategyFastest); ordered[0] != "b" {
+		t.Fatalf("expected b to be queried first after a timed out, got %v", ordered)
+	}
+
+	// While b keeps answering, the RTT of a decays until it is tried again
+	s.rttMu.Lock()
+	s.rttAt["a"] = s.rttAt["a"].Add(-10 * rttDecayInterval)
+	s.rttMu.Unlock()
+	s.updateRTT("b", 30*time.Millisecond, nil)
+	if ordered := s.orderUpstreams(nservers, StrategyFastest); ordered[0] != "a" {
+		t.Fatalf("expected a to be tried again, got %v", ordered)
+	}
+
+	// Once it answers fast again it stays first
+	s.updateRTT("a", 10*time.Millisecond, nil)
+	if ordered := s.orderUpstreams(nservers, StrategyFastest); ordered[0] != "a" {
+		t.Fatalf("expected a to be queried first after it recovered, got %v", ordered)
+	}
+}
+
+func TestExchangeTCPFallback(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if isTCP(w) {
+			m.Answer = []dns.RR{newA("example. 3600 IN A 192.0.2.1")}
+		} else {
+			m.Truncated = true
+		}
+		w.WriteMsg(m)
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Skipf("unable to listen on udp %s: %v", l.Addr(), err)
+	}
+	tcpServer := &dns.Server{Listener: l, Handler: handler}
+	udpServer := &dns.Server{PacketConn: pc, Handler: handler}
+	go tcpServer.ActivateAndServe()
+	go udpServer.ActivateAndServe()
+	defer tcpServer.Shutdown()
+	defer udpServer.Shutdown()
+
+	s := newTestStrategyServer()
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+
+	r, err := s.exchange(context.Background(), l.Addr().String(), req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Truncated || len(r.Answer) != 1 {
+		t.Fatalf("expected full answer over TCP, got %v", r)
+	}
+
+	s.config().NoTCPFallback = true
+	r, err = s.exchange(context.Background(), l.Addr().String(), req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Truncated {
+		t.Fatalf("expected truncated answer with TCP fallback disabled, got %v", r)
+	}
+}
+
+func TestPlainUpstreamSingleInflight(t *testing.T) {
+	var queries int32
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(100 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("unable to listen on udp: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	u := newPlainUpstream(pc.LocalAddr().String(), time.Second)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := u.Exchange(context.Background(), req, false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("expected 1 query to the upstream, got %d", n)
+	}
+
+	// The deadline of the context is applied to each query
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := u.Exchange(ctx, req, false); !isTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How often the certificate files are checked for changes.
+var certCheckInterval = 10 * time.Second
+
+// certLoader holds the certificate served by the TLS listeners. The certificate
+// and key files are checked for changes during handshakes and reloaded when
+// either of them has been modified.
+type certLoader struct {
+	certFile string
+	keyFile  string
+
+	sync.Mutex
+	cert      *tls.Certificate
+	mtime     time.Time // latest modification time of cert and key file
+	lastCheck time.Time
+}
+
+func newCertLoader(certFile, keyFile string) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile}
+	mtime, err := l.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.load(mtime); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetCertificate implements the tls.Config callback of the same name.
+func (l *certLoader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if time.Since(l.lastCheck) < certCheckInterval {
+		return l.cert, nil
+	}
+	l.lastCheck = time.Now()
+
+	mtime, err := l.modTime()
+	if err != nil {
+		log.Warnf("Error stating TLS certificate: %s", err)
+		return l.cert, nil
+	}
+	if mtime.Equal(l.mtime) {
+		return l.cert, nil
+	}
+
+	if err := l.load(mtime); err != nil {
+		// Keep serving the previous certificate
+		log.Warnf("Error reloading TLS certificate: %s", err)
+		return l.cert, nil
+	}
+	log.Infof("Reloaded TLS certificate %s", l.certFile)
+	return l.cert, nil
+}
+
+// load reads the key pair from disk. Must be called with the lock held
+// or before the loader is shared.
+func (l *certLoader) load(mtime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cert
+	l.mtime = mtime
+	l.lastCheck = time.Now()
+	return nil
+}
+
+func (l *certLoader) modTime() (time.Time, error) {
+	var mtime time.Time
+	for _, path := range []string{l.certFile, l.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return mtime, err
+		}
+		if fi.ModTime().After(mtime) {
+			mtime = fi.ModTime()
+		}
+	}
+	return mtime, nil
+}
+
+// tlsConfig returns the server side TLS configuration for the encrypted listeners.
+func (s *server) tlsConfig() (*tls.Config, error) {
+	l, err := newCertLoader(s.config().TLSCertFile, s.config().TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: l.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key to the
+// files and returns the certificate.
+func writeCert(t *testing.T, certFile, keyFile, name string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// tlsAddr waits for the server to listen and returns its DNS-over-TLS address.
+func tlsAddr(t *testing.T, s *server) string {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		for _, srv := range s.dnsServers {
+			if srv.Net == "tcp-tls" {
+				s.mu.Unlock()
+				return srv.Listener.Addr().String()
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("server did not start listening")
+	return ""
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeCert(t, certFile, keyFile, "first")
+
+	interval := certCheckInterval
+	certCheckInterval = 0
+	defer func() { certCheckInterval = interval }()
+
+	config := &Config{
+		DnsAddr:     "127.0.0.1:0",
+		TLSAddr:     "127.0.0.1:0",
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		NoRec:       true,
+		RCacheTtl:   60,
+		Ndots:       1,
+	}
+	CheckConfig(config)
+	hosts := testHostfile{"tls.example.": {net.ParseIP("192.0.2.1")}}
+	s := New(hosts, config, "test")
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	defer func() { s.Stop(); <-done }()
+	addr := tlsAddr(t, s)
+
+	// query answers a DoT query, trusting only cert, and returns the
+	// certificate served
+	query := func(cert *x509.Certificate) *x509.Certificate {
+		pool := x509.NewCertPool()
+		pool.AddCert(cert)
+		c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool}, Timeout: time.Second}
+		conn, err := c.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		req := new(dns.Msg)
+		req.SetQuestion("tls.example.", dns.TypeA)
+		r, _, err := c.ExchangeWithConn(req, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Answer) != 1 {
+			t.Fatalf("bad answer, got %v", r.Answer)
+		}
+		return conn.Conn.(*tls.Conn).ConnectionState().PeerCertificates[0]
+	}
+	if served := query(cert); !served.Equal(cert) {
+		t.Fatalf("expected certificate %s, got %s", cert.Subject, served.Subject)
+	}
+
+	// The rewritten files are served on the next handshake
+	cert = writeCert(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if served := query(cert); !served.Equal(cert) {
+		t.Fatalf("expected reloaded certificate %s, got %s", cert.Subject, served.Subject)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const tlsScheme = "tls://"
+
+// upstream is a nameserver that queries are forwarded to.
+type upstream interface {
+	// Exchange sends the query to the nameserver and returns the reply before
+	// the deadline of ctx. tcp is true if the client query was received over
+	// a stream transport.
+	Exchange(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, time.Duration, error)
+	// Close releases connections kept open to the nameserver.
+	Close()
+	String() string
+}
+
+// plainUpstream is a nameserver queried over plain UDP or TCP. Identical
+// queries in flight at the same time are only sent once.
+type plainUpstream struct {
+	addr string
+	udp  *dns.Client
+	tcp  *dns.Client
+}
+
+func newPlainUpstream(addr string, timeout time.Duration) *plainUpstream {
+	return &plainUpstream{
+		addr: addr,
+		udp:  &dns.Client{Net: "udp", Timeout: timeout, SingleInflight: true},
+		tcp:  &dns.Client{Net: "tcp", Timeout: timeout, SingleInflight: true},
+	}
+}
+
+type exchangeResult struct {
+	r   *dns.Msg
+	rtt time.Duration
+	err error
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, req *dns.Msg, tcp bool) (*dns.Msg, time.Duration, error) {
+	c := u.udp
+	if tcp {
+		c = u.tcp
+	}
+	// The clients are shared, so the deadline of ctx can't be set on them.
+	// The query is copied as the caller may reuse it when we give up waiting.
+	req = req.Copy()
+	done := make(chan exchangeResult, 1)
+	go func() {
+		r, rtt, err := c.Exchange(req, u.addr)
+		done <- exchangeResult{r, rtt, err}
+	}()
+	select {
+	case res := <-done:
+		return res.r, res.rtt, res.err
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+func (u *plainUpstream) String() string { return u.addr }
+
+func (u *plainUpstream) Close() {}
+
+// upstream returns the upstream for the nameserver address, creating it on first use.
+func (s *server) upstream(addr string) (upstream, error) {
+	s.upstreamMu.Lock()
+	defer s.upstreamMu.Unlock()
+
+	if u, ok := s.upstreams[addr]; ok {
+		return u, nil
+	}
+
+	var u upstream
+	switch {
+	case strings.HasPrefix(addr, tlsScheme):
+		hostPort, serverName := splitServerName(strings.TrimPrefix(addr, tlsScheme))
+		tlsConfig, err := s.upstreamTLSConfig(serverName)
+		if err != nil {
+			return nil, err
+		}
+		u = newTLSUpstream(addr, hostPort, tlsConfig, s.config().FwdTimeout)
+	case strings.HasPrefix(addr, httpsScheme):
+		tlsConfig, err := s.upstreamTLSConfig("")
+		if err != nil {
+			return nil, err
+		}
+		u = newHTTPSUpstream(addr, tlsConfig, s.config().FwdTimeout)
+	default:
+		u = newPlainUpstream(addr, s.config().FwdTimeout)
+	}
+
+	s.upstreams[addr] = u
+	return u, nil
+}
+
+// timeout returns the time left until the deadline of ctx, or def if ctx has no deadline.
+func timeout(ctx context.Context, def time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return def
+}
+
+// upstreamTLSConfig returns the client TLS configuration used to verify
+// encrypted upstreams. If no server name is given the host of the dialed
+// address is verified.
+func (s *server) upstreamTLSConfig(serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if s.config().UpstreamCAFile != "" {
+		pool, err := loadCertPool(s.config().UpstreamCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// loadCertPool reads a PEM encoded CA bundle.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// splitServerName splits host:port#servername. If no server name is
+// given the host is used.
+func splitServerName(s string) (hostPort, serverName string) {
+	hostPort = s
+	if i := strings.Index(s, "#"); i >= 0 {
+		hostPort, serverName = s[:i], s[i+1:]
+	}
+	if serverName == "" {
+		if host, _, err := net.SplitHostPort(hostPort); err == nil {
+			serverName = host
+		}
+	}
+	return
+}
+
+// ParseNameserver validates a nameserver address and adds the default port
+// if none is given. Plain nameservers are given as host[:port], DNS-over-TLS
+// nameservers as tls://host[:port][#servername] and DNS-over-HTTPS nameservers
+// as https://host[:port][/path].
+func ParseNameserver(ns string) (string, error) {
+	ns = strings.TrimSpace(ns)
+	if strings.HasPrefix(ns, tlsScheme) {
+		hostPort, serverName := strings.TrimPrefix(ns, tlsScheme), ""
+		if i := strings.Index(hostPort, "#"); i >= 0 {
+			hostPort, serverName = hostPort[:i], hostPort[i+1:]
+		}
+		hostPort = AddDefaultPort(hostPort, "853")
+		if err := ValidateHostPort(hostPort); err != nil {
+			return "", err
+		}
+		if serverName != "" {
+			return tlsScheme + hostPort + "#" + serverName, nil
+		}
+		return tlsScheme + hostPort, nil
+	}
+
+	if strings.HasPrefix(ns, httpsScheme) {
+		u, err := url.Parse(ns)
+		if err != nil {
+			return "", err
+		}
+		if u.Host == "" {
+			return "", fmt.Errorf("Missing host in URL: %s", ns)
+		}
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		return u.String(), nil
+	}
+
+	hostPort := AddDefaultPort(ns, "53")
+	if err := ValidateHostPort(hostPort); err != nil {
+		return "", err
+	}
+	return hostPort, nil
+}
+
+// AddDefaultPort appends the port to hostPort if it does not specify one.
+func AddDefaultPort(hostPort, port string) string {
+	if strings.HasSuffix(hostPort, "]") || !strings.Contains(hostPort, ":") {
+		return hostPort + ":" + port
+	}
+	return hostPort
+}
+
+// ValidateHostPort checks that hostPort is an IP address with a valid port.
+func ValidateHostPort(hostPort string) error {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		return fmt.Errorf("Bad IP address: %s", host)
+	}
+
+	if p, _ := strconv.Atoi(port); p < 1 || p > 65535 {
+		return fmt.Errorf("Bad port number %s", port)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const httpsScheme = "https://"
+
+// httpsUpstream is a DNS-over-HTTPS (RFC 8484) nameserver. Connections are
+// kept alive and reused by the HTTP/2 transport.
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSUpstream(url string, config *tls.Config, timeout time.Duration) *httpsUpstream {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:     config,
+		TLSHandshakeTimeout: timeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &httpsUpstream{
+		url:    url,
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+func (u *httpsUpstream) Close() {
+	u.client.Transport.(*http.Transport).CloseIdleConnections()
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, req *dns.Msg, _ bool) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+
+	// RFC 8484 4.1: use a message id of 0 to make responses cache friendly
+	m := req.Copy()
+	m.Id = 0
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", dohMimeType)
+	httpReq.Header.Set("Accept", dohMimeType)
+
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Since(start), fmt.Errorf("Unexpected HTTP status from %s: %s", u.url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMimeType {
+		return nil, time.Since(start), fmt.Errorf("Unexpected content type from %s: %s", u.url, ct)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, time.Since(start), err
+	}
+	r.Id = req.Id
+
+	if maxAge, ok := parseMaxAge(resp.Header.Get("Cache-Control")); ok {
+		capTTL(r, maxAge)
+	}
+	return r, time.Since(start), nil
+}
+
+// parseMaxAge returns the max-age directive of a Cache-Control header.
+func parseMaxAge(cacheControl string) (uint32, bool) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		age, err := strconv.ParseUint(strings.TrimPrefix(directive, "max-age="), 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		return uint32(age), true
+	}
+	return 0, false
+}
+
+// capTTL lowers the TTL of all resource records to at most ttl seconds.
+func capTTL(m *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
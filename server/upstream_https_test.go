@@ -0,0 +1,74 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHTTPSUpstreamExchange(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(buf); err != nil || req.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{newA("example. 3600 IN A 192.0.2.1")}
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", dohMimeType)
+		w.Header().Set("Cache-Control", "public, max-age=120")
+		w.Write(out)
+	}))
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	u := newHTTPSUpstream(ts.URL+dohPath, &tls.Config{RootCAs: pool}, time.Second)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	r, _, err := u.Exchange(context.Background(), req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != req.Id {
+		t.Fatalf("bad id, expected %d, got %d", req.Id, r.Id)
+	}
+	if len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 120 {
+		t.Fatalf("expected answer with TTL capped to max-age, got %v", r.Answer)
+	}
+}
+
+func TestParseMaxAge(t *testing.T) {
+	testcases := []struct {
+		header string
+		age    uint32
+		ok     bool
+	}{
+		{"max-age=60", 60, true},
+		{"public, max-age=3600", 3600, true},
+		{"no-cache", 0, false},
+		{"max-age=foo", 0, false},
+		{"", 0, false},
+	}
+	for _, tc := range testcases {
+		age, ok := parseMaxAge(tc.header)
+		if age != tc.age || ok != tc.ok {
+			t.Errorf("parseMaxAge(%q): expected %d/%t, got %d/%t", tc.header, tc.age, tc.ok, age, ok)
+		}
+	}
+}
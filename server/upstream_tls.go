@@ -0,0 +1,207 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Number of persistent connections kept open to each DNS-over-TLS upstream.
+const tlsPoolSize = 4
+
+var (
+	errUpstreamTimeout = errors.New("upstream timeout")
+	errUpstreamClosed  = errors.New("upstream closed")
+)
+
+// tlsUpstream is a DNS-over-TLS (RFC 7858) nameserver. Queries are pipelined
+// over a small pool of persistent connections.
+type tlsUpstream struct {
+	name    string // address as configured, e.g. tls://1.1.1.1:853#cloudflare-dns.com
+	addr    string // host:port to dial
+	config  *tls.Config
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conns  [tlsPoolSize]*pipeConn
+	next   int
+	closed bool
+}
+
+func newTLSUpstream(name, addr string, config *tls.Config, timeout time.Duration) *tlsUpstream {
+	return &tlsUpstream{name: name, addr: addr, config: config, timeout: timeout}
+}
+
+func (u *tlsUpstream) String() string { return u.name }
+
+func (u *tlsUpstream) Close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	for i, c := range u.conns {
+		if c != nil {
+			c.close(errUpstreamClosed)
+			u.conns[i] = nil
+		}
+	}
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, req *dns.Msg, _ bool) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	c, err := u.conn()
+	if err != nil {
+		return nil, 0, err
+	}
+	r, err := c.exchange(req, timeout(ctx, u.timeout))
+	return r, time.Since(start), err
+}
+
+// conn returns the next pooled connection, replacing it if it was closed.
+// The lock isn't held while dialing, so a slow handshake doesn't hold up
+// queries on the other connections.
+func (u *tlsUpstream) conn() (*pipeConn, error) {
+	u.mu.Lock()
+	i := u.next
+	u.next = (u.next + 1) % tlsPoolSize
+	c := u.conns[i]
+	u.mu.Unlock()
+	if c != nil && !c.closed() {
+		return c, nil
+	}
+
+	dialer := &net.Dialer{Timeout: u.timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", u.addr, u.config)
+	if err != nil {
+		return nil, err
+	}
+	c = newPipeConn(conn)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.closed {
+		c.close(errUpstreamClosed)
+		return nil, errUpstreamClosed
+	}
+	// Another query may have replaced the connection while we were dialing
+	if old := u.conns[i]; old != nil && !old.closed() {
+		c.close(errUpstreamClosed)
+		return old, nil
+	}
+	log.Debugf("Opened TLS connection to upstream %s", u.name)
+	u.conns[i] = c
+	return c, nil
+}
+
+// pipeConn multiplexes concurrent queries over a single stream connection,
+// matching replies to queries by message id.
+type pipeConn struct {
+	conn *dns.Conn
+
+	wmu sync.Mutex // serializes writes
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	err     error
+	done    chan struct{}
+}
+
+func newPipeConn(conn net.Conn) *pipeConn {
+	c := &pipeConn{
+		conn:    &dns.Conn{Conn: conn},
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *pipeConn) exchange(req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	// Pick a message id that is unique on this connection
+	id := dns.Id()
+	for _, ok := c.pending[id]; ok; _, ok = c.pending[id] {
+		id = dns.Id()
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	m := req.Copy()
+	m.Id = id
+
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := c.conn.WriteMsg(m)
+	c.wmu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		r.Id = req.Id
+		return r, nil
+	case <-c.done:
+		return nil, c.err
+	case <-timer.C:
+		// Only this query failed, the others in flight on the connection
+		// may still be answered. A late reply is dropped by readLoop.
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, errUpstreamTimeout
+	}
+}
+
+func (c *pipeConn) readLoop() {
+	for {
+		r, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[r.Id]
+		delete(c.pending, r.Id)
+		c.mu.Unlock()
+		if ok {
+			ch <- r
+		}
+	}
+}
+
+func (c *pipeConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *pipeConn) closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
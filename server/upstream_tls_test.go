@@ -0,0 +1,94 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serveReversed reads n queries from the connection and answers them in reverse order.
+func serveReversed(t *testing.T, conn net.Conn, n int) {
+	c := &dns.Conn{Conn: conn}
+	var reqs []*dns.Msg
+	for i := 0; i < n; i++ {
+		req, err := c.ReadMsg()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		reqs = append(reqs, req)
+	}
+	for i := len(reqs) - 1; i >= 0; i-- {
+		m := new(dns.Msg)
+		m.SetReply(reqs[i])
+		m.Answer = []dns.RR{newA(reqs[i].Question[0].Name + " 10 IN A 192.0.2.1")}
+		if err := c.WriteMsg(m); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestPipeConnOutOfOrder(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+	go serveReversed(t, srv, 3)
+
+	c := newPipeConn(client)
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			r, err := c.exchange(req, time.Second)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r.Id != req.Id {
+				t.Errorf("bad id, expected %d, got %d", req.Id, r.Id)
+			}
+			if r.Answer[0].Header().Name != name {
+				t.Errorf("bad answer, expected %s, got %s", name, r.Answer[0].Header().Name)
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+func TestPipeConnTimeout(t *testing.T) {
+	client, srv := net.Pipe()
+	defer srv.Close()
+	go func() {
+		// Leave the first query unanswered, answer the second
+		conn := &dns.Conn{Conn: srv}
+		if _, err := conn.ReadMsg(); err != nil {
+			return
+		}
+		serveReversed(t, srv, 1)
+	}()
+
+	c := newPipeConn(client)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	if _, err := c.exchange(req, 50*time.Millisecond); err != errUpstreamTimeout {
+		t.Fatalf("bad error, expected %v, got %v", errUpstreamTimeout, err)
+	}
+	if c.closed() {
+		t.Fatal("connection expected to stay open after a timeout")
+	}
+	if _, err := c.exchange(req, time.Second); err != nil {
+		t.Fatalf("expected an answer on the same connection, got %v", err)
+	}
+}
+
+func newA(rr string) *dns.A { r, _ := dns.NewRR(rr); return r.(*dns.A) }
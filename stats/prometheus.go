@@ -0,0 +1,37 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"net"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const prometheusPath = "/metrics"
+
+// collectPrometheus serves the metrics at prometheusPath on addr.
+func collectPrometheus(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(prometheusPath, promhttp.Handler())
+	log.Infof("Serving Prometheus metrics on http://%s%s", addr, prometheusPath)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Prometheus metrics listener on %s failed: %s", addr, err)
+		}
+	}()
+	onStop(func() { srv.Close() })
+	return nil
+}
@@ -0,0 +1,316 @@
+// Copyright (c) 2014 The SkyDNS Authors. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+// Package stats may be imported to record statistics about a DNS server.
+// If the GRAPHITE_SERVER environment variable is set, the statistics can
+// be periodically reported to that server, likewise with STATSD_SERVER for a
+// StatsD agent. They can also be served in the Prometheus exposition format.
+package stats
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+
+	"github.com/janeczku/go-dnsmasq/server"
+)
+
+const namespace = "dnsmasq"
+
+// Buckets for response times, from 250µs to 4s
+var durationBuckets = prometheus.ExponentialBuckets(0.00025, 2, 15)
+
+func init() {
+	server.StatsForwardCount = newCounter("forward-requests", "Queries forwarded to the nameservers.")
+	server.StatsStubForwardCount = newCounter("stub-forward-requests", "Queries forwarded to the nameservers of stub zones.")
+	server.StatsTCPFallbackCount = newCounter("tcp-fallback-requests", "Truncated responses retried over TCP.")
+	server.StatsDnssecOkCount = newCounter("dnssecok-requests", "Queries with the DO bit set.")
+	server.StatsDnssecCacheMiss = newCounter("dnssec-cache-miss", "DNSSEC queries not answered from the cache.")
+	server.StatsLookupCount = newCounter("internal-lookups", "Queries answered internally.")
+	server.StatsRequestCount = newCounter("requests", "Queries received from clients.")
+	server.StatsNameErrorCount = newCounter("nameerror-responses", "NXDOMAIN responses.")
+	server.StatsNoDataCount = newCounter("nodata-responses", "NODATA responses.")
+	server.StatsCacheMiss = newCounter("cache-miss", "Queries not answered from the cache.")
+	server.StatsCacheHit = newCounter("cache-hit", "Queries answered from the cache.")
+	server.StatsUpstreamProbeFailCount = newCounter("upstream-probe-failures", "Failed health check probes.")
+	server.StatsUpstreamDownCount = newCounter("upstream-down", "Nameservers marked as down.")
+	server.StatsUpstreamUpCount = newCounter("upstream-up", "Nameservers marked as up again.")
+
+	server.StatsResponseCount = newCounterVec("responses", "Responses sent to clients.",
+		"qtype", "rcode", "transport")
+	server.StatsResponseTime = newHistogramVec("response-duration-seconds", "Time to answer client queries.",
+		"transport")
+	server.StatsAnswerCount = newCounterVec("answers", "Responses sent to clients by outcome and source.",
+		"outcome", "source", "transport")
+	server.StatsCacheEvictionCount = newCounterVec("cache-evictions", "Responses removed from the cache.",
+		"reason")
+	server.StatsUpstreamQueryCount = newCounterVec("upstream-queries", "Queries sent to nameservers.",
+		"upstream")
+	server.StatsUpstreamResponseCount = newCounterVec("upstream-responses", "Responses received from nameservers.",
+		"upstream", "rcode")
+	server.StatsUpstreamErrorCount = newCounterVec("upstream-errors", "Queries to nameservers that failed or timed out.",
+		"upstream", "reason")
+	server.StatsUpstreamResponseTime = newHistogramVec("upstream-duration-seconds", "Response times of nameservers.",
+		"upstream")
+	server.StatsUpstreamRTT = newGaugeVec("upstream-srtt-seconds", "Smoothed response times of nameservers.",
+		"upstream")
+	server.StatsUpstreamHealthy = newGaugeVec("upstream-healthy", "Whether health checking considers a nameserver up.",
+		"upstream")
+}
+
+// Collect starts reporting the statistics to the backends configured in the
+// environment and serves them for Prometheus on prometheusAddr, unless it is
+// empty.
+func Collect(prometheusAddr string) error {
+	collectGraphite()
+	if err := collectStatsd(); err != nil {
+		return err
+	}
+	return collectPrometheus(prometheusAddr)
+}
+
+var (
+	stopMu   sync.Mutex
+	stoppers []func()
+)
+
+// onStop registers f to be called by Stop.
+func onStop(f func()) {
+	stopMu.Lock()
+	stoppers = append(stoppers, f)
+	stopMu.Unlock()
+}
+
+// Stop ends the reporting started by Collect, sending the last changes to
+// StatsD and closing the Prometheus listener.
+func Stop() {
+	stopMu.Lock()
+	defer stopMu.Unlock()
+	for _, f := range stoppers {
+		f()
+	}
+	stoppers = nil
+}
+
+// counter is registered with go-metrics and Prometheus.
+type counter struct {
+	metrics.Counter
+	prom prometheus.Counter
+}
+
+func (c counter) Inc(i int64) {
+	c.Counter.Inc(i)
+	c.prom.Add(float64(i))
+}
+
+func newCounter(name, help string) server.Counter {
+	c := counter{
+		Counter: metrics.NewCounter(),
+		prom: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      promName(name) + "_total",
+			Help:      help,
+		}),
+	}
+	metrics.Register(metricsName(name, nil, nil), c.Counter)
+	prometheus.MustRegister(c.prom)
+	return c
+}
+
+// maxLabels is the largest number of labels of a metric vector.
+const maxLabels = 3
+
+// labelValues are the label values of a metric in a vector. As an array it
+// can be used as a map key without allocating.
+type labelValues [maxLabels]string
+
+// metricCache holds the metrics of a vector by their label values, so the
+// registries are only consulted when a combination of values is first used.
+type metricCache struct {
+	mu sync.RWMutex
+	m  map[labelValues]interface{}
+}
+
+func newMetricCache(labels []string) *metricCache {
+	if len(labels) > maxLabels {
+		panic("stats: too many labels")
+	}
+	return &metricCache{m: make(map[labelValues]interface{})}
+}
+
+func (c *metricCache) load(values []string) (interface{}, bool) {
+	var k labelValues
+	copy(k[:], values)
+	c.mu.RLock()
+	m, ok := c.m[k]
+	c.mu.RUnlock()
+	return m, ok
+}
+
+func (c *metricCache) store(values []string, m interface{}) {
+	var k labelValues
+	copy(k[:], values)
+	c.mu.Lock()
+	c.m[k] = m
+	c.mu.Unlock()
+}
+
+// counterVec is a Prometheus counter vector. For go-metrics a counter is
+// registered for every combination of label values, with the values appended
+// to the name.
+type counterVec struct {
+	name   string
+	labels []string
+	prom   *prometheus.CounterVec
+	cache  *metricCache
+}
+
+func (c counterVec) Inc(i int64, values ...string) {
+	m, ok := c.cache.load(values)
+	if !ok {
+		// Copied, so that values doesn't escape on the cached path
+		vs := append([]string(nil), values...)
+		m = counter{
+			Counter: metrics.GetOrRegisterCounter(metricsName(c.name, c.labels, vs), nil),
+			prom:    c.prom.WithLabelValues(vs...),
+		}
+		c.cache.store(vs, m)
+	}
+	m.(counter).Inc(i)
+}
+
+func newCounterVec(name, help string, labels ...string) server.CounterVec {
+	c := counterVec{name, labels, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      promName(name) + "_total",
+		Help:      help,
+	}, labels), newMetricCache(labels)}
+	prometheus.MustRegister(c.prom)
+	return c
+}
+
+// histogramVec is a Prometheus histogram vector. For go-metrics it uses a
+// timer for every combination of label values.
+type histogramVec struct {
+	name   string
+	labels []string
+	prom   *prometheus.HistogramVec
+	cache  *metricCache
+}
+
+// histogram is a go-metrics timer and a Prometheus histogram.
+type histogram struct {
+	metrics.Timer
+	prom prometheus.Observer
+}
+
+func (h histogramVec) Observe(d time.Duration, values ...string) {
+	m, ok := h.cache.load(values)
+	if !ok {
+		vs := append([]string(nil), values...)
+		m = histogram{
+			Timer: metrics.GetOrRegisterTimer(metricsName(h.name, h.labels, vs), nil),
+			prom:  h.prom.WithLabelValues(vs...),
+		}
+		h.cache.store(vs, m)
+	}
+	m.(histogram).prom.Observe(d.Seconds())
+	m.(histogram).Update(d)
+}
+
+func newHistogramVec(name, help string, labels ...string) server.HistogramVec {
+	h := histogramVec{name, labels, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      promName(name),
+		Help:      help,
+		Buckets:   durationBuckets,
+	}, labels), newMetricCache(labels)}
+	prometheus.MustRegister(h.prom)
+	return h
+}
+
+// gaugeVec is a Prometheus gauge vector. For go-metrics it uses a gauge for
+// every combination of label values.
+type gaugeVec struct {
+	name   string
+	labels []string
+	prom   *prometheus.GaugeVec
+	cache  *metricCache
+}
+
+// gauge is a go-metrics gauge and a Prometheus gauge.
+type gauge struct {
+	metrics.GaugeFloat64
+	prom prometheus.Gauge
+}
+
+func (g gaugeVec) Set(v float64, values ...string) {
+	m, ok := g.cache.load(values)
+	if !ok {
+		vs := append([]string(nil), values...)
+		m = gauge{
+			GaugeFloat64: metrics.GetOrRegisterGaugeFloat64(metricsName(g.name, g.labels, vs), nil),
+			prom:         g.prom.WithLabelValues(vs...),
+		}
+		g.cache.store(vs, m)
+	}
+	m.(gauge).prom.Set(v)
+	m.(gauge).Update(v)
+}
+
+func newGaugeVec(name, help string, labels ...string) server.GaugeVec {
+	g := gaugeVec{name, labels, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      promName(name),
+		Help:      help,
+	}, labels), newMetricCache(labels)}
+	prometheus.MustRegister(g.prom)
+	return g
+}
+
+// labeledMetric is the name and the labels of a go-metrics metric, for sinks
+// that report labels as tags.
+type labeledMetric struct {
+	name   string
+	labels []string
+	values []string
+}
+
+// metricsNamePrefix starts the go-metrics names reported to Graphite and
+// StatHat. The default keeps the misspelled names of earlier releases, so
+// existing dashboards continue to work.
+var metricsNamePrefix = func() string {
+	if prefix := os.Getenv("METRICS_NAME_PREFIX"); prefix != "" {
+		return prefix
+	}
+	return "go-dnsmaq"
+}()
+
+// labeledMetrics maps go-metrics names to labeledMetric.
+var labeledMetrics sync.Map
+
+// metricsName returns the go-metrics name for a metric with label values.
+// Characters that separate the path of Graphite metrics are replaced in the
+// label values.
+func metricsName(name string, labels, values []string) string {
+	parts := []string{metricsNamePrefix + "-" + name}
+	for _, v := range values {
+		parts = append(parts, labelReplacer.Replace(v))
+	}
+	full := strings.Join(parts, ".")
+	if _, ok := labeledMetrics.Load(full); !ok {
+		labeledMetrics.Store(full, labeledMetric{name, labels, values})
+	}
+	return full
+}
+
+var labelReplacer = strings.NewReplacer(".", "_", ":", "_", "/", "_", " ", "_")
+
+func promName(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	statsdServer   = os.Getenv("STATSD_SERVER")
+	statsdPrefix   = os.Getenv("STATSD_PREFIX")
+	statsdFormat   = os.Getenv("STATSD_FORMAT")
+	statsdInterval = os.Getenv("STATSD_INTERVAL")
+)
+
+// Maximum payload of a StatsD packet, to stay below common MTUs
+const statsdMaxPacket = 1432
+
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", ":", "_")
+
+// collectStatsd periodically sends the metrics to STATSD_SERVER.
+func collectStatsd() error {
+	if statsdServer == "" {
+		return nil
+	}
+	if statsdPrefix == "" {
+		statsdPrefix = "go-dnsmasq"
+	}
+	interval := 10 * time.Second
+	if statsdInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(statsdInterval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid STATSD_INTERVAL: %s", statsdInterval)
+		}
+	}
+	var tags bool
+	switch statsdFormat {
+	case "", "statsd":
+	case "dogstatsd":
+		tags = true
+	default:
+		return fmt.Errorf("invalid STATSD_FORMAT: %s", statsdFormat)
+	}
+
+	conn, err := net.Dial("udp", statsdServer)
+	if err != nil {
+		return err
+	}
+	s := newStatsd(statsdPrefix, tags)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer conn.Close()
+		s.run(conn, metrics.DefaultRegistry, interval, done)
+	}()
+	onStop(func() {
+		close(done)
+		<-stopped
+	})
+	return nil
+}
+
+// How often failures to send to StatsD are logged at most.
+const statsdErrorInterval = time.Minute
+
+// run sends the metrics of r every interval until done is closed, and once
+// more before returning.
+func (s *statsd) run(w io.Writer, r metrics.Registry, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush(w, r)
+		case <-done:
+			s.flush(w, r)
+			return
+		}
+	}
+}
+
+// flush sends the changes of the metrics of r. Write errors are logged at
+// most once per statsdErrorInterval.
+func (s *statsd) flush(w io.Writer, r metrics.Registry) {
+	for _, p := range s.packets(r) {
+		if _, err := w.Write(p); err != nil {
+			s.failures++
+			if time.Since(s.lastError) >= statsdErrorInterval {
+				log.Warnf("Failed to send metrics to StatsD (%d failures): %s", s.failures, err)
+				s.lastError, s.failures = time.Now(), 0
+			}
+		}
+	}
+}
+
+// statsd formats go-metrics metrics in the StatsD line protocol. With tags the
+// label values are sent as DogStatsD tags, otherwise they are appended to the
+// metric names.
+type statsd struct {
+	prefix string
+	tags   bool
+	last   map[string]int64 // counts sent so far, StatsD counters are deltas
+
+	lastError time.Time // when a failure to send was last logged
+	failures  int       // failures to send since then
+}
+
+func newStatsd(prefix string, tags bool) *statsd {
+	return &statsd{prefix: prefix, tags: tags, last: make(map[string]int64)}
+}
+
+// packets returns the changes since the last call, split into packets.
+func (s *statsd) packets(r metrics.Registry) [][]byte {
+	var lines []string
+	r.Each(func(name string, i interface{}) {
+		_, timer := i.(metrics.Timer)
+		name, tags := s.name(name, timer)
+		switch m := i.(type) {
+		case metrics.Counter:
+			if delta := s.delta(name+tags, m.Count()); delta != 0 {
+				lines = append(lines, fmt.Sprintf("%s:%d|c%s", name, delta, tags))
+			}
+		case metrics.GaugeFloat64:
+			lines = append(lines, fmt.Sprintf("%s:%s|g%s", name, formatFloat(m.Value()), tags))
+		case metrics.Timer:
+			t := m.Snapshot()
+			if delta := s.delta(name+tags, t.Count()); delta != 0 {
+				lines = append(lines, fmt.Sprintf("%s.count:%d|c%s", name, delta, tags))
+			}
+			if t.Count() == 0 {
+				return
+			}
+			ps := t.Percentiles([]float64{0.5, 0.95, 0.99})
+			values := []struct {
+				suffix string
+				v      float64
+			}{{"mean", t.Mean()}, {"p50", ps[0]}, {"p95", ps[1]}, {"p99", ps[2]}, {"max", float64(t.Max())}}
+			for _, v := range values {
+				lines = append(lines, fmt.Sprintf("%s.%s:%s|g%s", name, v.suffix, formatFloat(v.v/1e6), tags))
+			}
+		}
+	})
+
+	var packets [][]byte
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			packets = append(packets, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
+
+// name returns the StatsD name and the DogStatsD tags of a go-metrics metric.
+func (s *statsd) name(name string, timer bool) (string, string) {
+	v, ok := labeledMetrics.Load(name)
+	if !ok {
+		return s.prefix + "." + name, ""
+	}
+	m := v.(labeledMetric)
+	name = s.prefix + "." + m.name
+	if timer {
+		// Durations are sent in milliseconds
+		name = strings.TrimSuffix(name, "-seconds")
+	}
+	if !s.tags {
+		for _, v := range m.values {
+			name += "." + labelReplacer.Replace(v)
+		}
+		return name, ""
+	}
+	if len(m.labels) == 0 {
+		return name, ""
+	}
+	var tags []string
+	for i, label := range m.labels {
+		tags = append(tags, label+":"+tagReplacer.Replace(m.values[i]))
+	}
+	return name, "|#" + strings.Join(tags, ",")
+}
+
+func (s *statsd) delta(key string, count int64) int64 {
+	delta := count - s.last[key]
+	s.last[key] = count
+	return delta
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2015 Jan Broer. All rights reserved.
+// Use of this source code is governed by The MIT License (MIT) that can be
+// found in the LICENSE file.
+
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rcrowley/go-metrics"
+)
+
+func testRegistry() metrics.Registry {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter(metricsName("test-requests", nil, nil), r).Inc(3)
+	metrics.GetOrRegisterCounter(metricsName("test-answers", []string{"outcome", "upstream"},
+		[]string{"NOERROR", "8.8.8.8:53"}), r).Inc(2)
+	metrics.GetOrRegisterGaugeFloat64(metricsName("test-healthy", []string{"upstream"},
+		[]string{"8.8.8.8:53"}), r).Update(1)
+	metrics.GetOrRegisterTimer(metricsName("test-duration-seconds", []string{"transport"},
+		[]string{"udp"}), r).Update(2 * time.Millisecond)
+	return r
+}
+
+func lines(packets [][]byte) []string {
+	var lines []string
+	for _, p := range packets {
+		lines = append(lines, strings.Split(string(p), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestStatsdPackets(t *testing.T) {
+	testcases := []struct {
+		tags     bool
+		expected []string
+	}{
+		{false, []string{
+			"dns.test-answers.NOERROR.8_8_8_8_53:2|c",
+			"dns.test-duration.udp.count:1|c",
+			"dns.test-duration.udp.max:2|g",
+			"dns.test-duration.udp.mean:2|g",
+			"dns.test-duration.udp.p50:2|g",
+			"dns.test-duration.udp.p95:2|g",
+			"dns.test-duration.udp.p99:2|g",
+			"dns.test-healthy.8_8_8_8_53:1|g",
+			"dns.test-requests:3|c",
+		}},
+		{true, []string{
+			"dns.test-answers:2|c|#outcome:NOERROR,upstream:8.8.8.8_53",
+			"dns.test-duration.count:1|c|#transport:udp",
+			"dns.test-duration.max:2|g|#transport:udp",
+			"dns.test-duration.mean:2|g|#transport:udp",
+			"dns.test-duration.p50:2|g|#transport:udp",
+			"dns.test-duration.p95:2|g|#transport:udp",
+			"dns.test-duration.p99:2|g|#transport:udp",
+			"dns.test-healthy:1|g|#upstream:8.8.8.8_53",
+			"dns.test-requests:3|c",
+		}},
+	}
+	for _, tc := range testcases {
+		r := testRegistry()
+		s := newStatsd("dns", tc.tags)
+		if got := lines(s.packets(r)); strings.Join(got, " ") != strings.Join(tc.expected, " ") {
+			t.Errorf("tags %v: expected %v, got %v", tc.tags, tc.expected, got)
+		}
+
+		// Counters are sent as deltas
+		r.Get(metricsName("test-requests", nil, nil)).(metrics.Counter).Inc(1)
+		for _, line := range lines(s.packets(r)) {
+			if strings.HasSuffix(line, "|c") && line != "dns.test-requests:1|c" {
+				t.Errorf("tags %v: unexpected counter %s", tc.tags, line)
+			}
+		}
+	}
+}
+
+func TestStatsdPacketSize(t *testing.T) {
+	r := metrics.NewRegistry()
+	for i := 0; i < 200; i++ {
+		metrics.GetOrRegisterGaugeFloat64(metricsName("test-gauge", []string{"n"},
+			[]string{strings.Repeat("x", i)}), r).Update(1)
+	}
+	packets := newStatsd("dns", true).packets(r)
+	if len(packets) < 2 {
+		t.Fatalf("expected several packets, got %d", len(packets))
+	}
+	for _, p := range packets {
+		if len(p) > statsdMaxPacket {
+			t.Fatalf("packet exceeds %d bytes: %d", statsdMaxPacket, len(p))
+		}
+	}
+	if n := len(lines(packets)); n != 200 {
+		t.Fatalf("expected 200 lines, got %d", n)
+	}
+}
+
+func TestMetricsName(t *testing.T) {
+	// Graphite and StatHat keep the names of earlier releases by default
+	name := metricsName("upstream-responses", []string{"upstream", "rcode"}, []string{"8.8.8.8:53", "NOERROR"})
+	if expected := "go-dnsmaq-upstream-responses.8_8_8_8_53.NOERROR"; name != expected {
+		t.Fatalf("expected %s, got %s", expected, name)
+	}
+}
+
+func TestCounterVecCached(t *testing.T) {
+	c := newCounterVec("test-cached", "Counter for testing.", "upstream", "rcode").(counterVec)
+	c.Inc(1, "192.0.2.1:53", "NOERROR")
+	if n := testing.AllocsPerRun(100, func() { c.Inc(1, "192.0.2.1:53", "NOERROR") }); n != 0 {
+		t.Fatalf("expected no allocations once the counter is known, got %v", n)
+	}
+	name := metricsName("test-cached", []string{"upstream", "rcode"}, []string{"192.0.2.1:53", "NOERROR"})
+	// AllocsPerRun calls the function once more to warm up
+	if n := metrics.Get(name).(metrics.Counter).Count(); n != 102 {
+		t.Fatalf("expected a count of 102, got %d", n)
+	}
+}
+
+type packetWriter chan []byte
+
+func (w packetWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestStatsdRunStop(t *testing.T) {
+	r := testRegistry()
+	s := newStatsd("dnsmasq", false)
+	w := make(packetWriter, 16)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		s.run(w, r, time.Hour, done)
+		close(stopped)
+	}()
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("run did not return after done was closed")
+	}
+	if len(w) == 0 {
+		t.Error("expected the metrics to be sent before returning")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestStatsdFlushErrors(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	r := testRegistry()
+	s := newStatsd("dnsmasq", false)
+	s.flush(failingWriter{}, r)
+	metrics.GetOrRegisterCounter(metricsName("test-requests", nil, nil), r).Inc(1)
+	s.flush(failingWriter{}, r)
+	if n := strings.Count(buf.String(), "Failed to send metrics"); n != 1 {
+		t.Fatalf("expected 1 logged failure, got %d: %s", n, buf.String())
+	}
+	if s.failures == 0 {
+		t.Error("expected the failures since the last log to be counted")
+	}
+
+	s.lastError = time.Now().Add(-statsdErrorInterval)
+	s.flush(failingWriter{}, r)
+	if n := strings.Count(buf.String(), "Failed to send metrics"); n != 2 {
+		t.Errorf("expected 2 logged failures after the interval, got %d", n)
+	}
+}